@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/gptlocal/wheels/net/faultnet"
+)
+
+type testServer struct {
+	UnimplementedFibonacciServer
+	interval time.Duration
+}
+
+func (s *testServer) Calculate(req *FibonacciRequest, stream Fibonacci_CalculateServer) error {
+	a, b := int64(0), int64(1)
+	for i := 0; i < int(req.GetNumber()); i++ {
+		if err := stream.Send(&FibonacciResponse{Result: a}); err != nil {
+			return err
+		}
+		time.Sleep(s.interval)
+		a, b = b, a+b
+	}
+	return nil
+}
+
+func startServer(t *testing.T, l *faultnet.Listener, interval time.Duration) FibonacciClient {
+	server := grpc.NewServer()
+	RegisterFibonacciServer(server, &testServer{interval: interval})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("faultnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return l.Dial()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewFibonacciClient(conn)
+}
+
+func TestCalculateFragmentedAndDelayed(t *testing.T) {
+	l := faultnet.Listen("fibonacci")
+	l.Server = func(conn *faultnet.Conn) {
+		conn.FragmentWrites(3)
+		conn.DelayReads(time.Millisecond)
+	}
+	l.Client = func(conn *faultnet.Conn) {
+		conn.FragmentWrites(5)
+		conn.DelayReads(time.Millisecond)
+	}
+	client := startServer(t, l, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.Calculate(ctx, &FibonacciRequest{Number: 20})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a, b := int64(0), int64(1)
+	for i := 0; ; i++ {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			if i != 20 {
+				t.Fatalf("expected 20 results, got %d", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if res.GetResult() != a {
+			t.Fatalf("bad result %d: %d", i, res.GetResult())
+		}
+		a, b = b, a+b
+	}
+}
+
+func TestCalculateReset(t *testing.T) {
+	clients := make(chan *faultnet.Conn, 1)
+	l := faultnet.Listen("fibonacci")
+	l.Client = func(conn *faultnet.Conn) { clients <- conn }
+	client := startServer(t, l, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.Calculate(ctx, &FibonacciRequest{Number: 90})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	(<-clients).Reset()
+	for {
+		_, err := stream.Recv()
+		if err == nil {
+			continue
+		}
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected Unavailable, got: %v", err)
+		}
+		break
+	}
+}
+
+func TestCalculateDeadline(t *testing.T) {
+	l := faultnet.Listen("fibonacci")
+	// Responses trickle in slower than the caller is willing to wait.
+	l.Client = func(conn *faultnet.Conn) { conn.DelayReads(50 * time.Millisecond) }
+	client := startServer(t, l, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stream, err := client.Calculate(ctx, &FibonacciRequest{Number: 90})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got: %v", err)
+	}
+}
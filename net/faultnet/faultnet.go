@@ -0,0 +1,336 @@
+// Package faultnet provides in-memory net.Conn pairs whose faults are injected on
+// command: fragmented writes, delayed reads, resets, half-closes and deadlines.
+package faultnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReset  = errors.New("faultnet: connection reset by peer")
+	ErrClosed = errors.New("faultnet: use of closed connection")
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "faultnet" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// stream is one direction of a pipe. Each write is kept as separate chunks so that
+// the reader observes the fragmentation chosen by the writer.
+type stream struct {
+	mu       sync.Mutex
+	chunks   [][]byte
+	eof      bool
+	err      error
+	deadline time.Time
+	changed  chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{changed: make(chan struct{})}
+}
+
+// notify wakes up the goroutines waiting on the stream, mu must be held.
+func (s *stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *stream) write(b []byte, fragment int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.eof {
+		return ErrClosed
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if fragment > 0 && n > fragment {
+			n = fragment
+		}
+		s.chunks = append(s.chunks, append([]byte(nil), b[:n]...))
+		b = b[n:]
+	}
+	s.notify()
+	return nil
+}
+
+// read returns at most one chunk, waiting for one until the read deadline.
+func (s *stream) read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		switch {
+		case s.err != nil:
+			s.mu.Unlock()
+			return 0, s.err
+		case len(s.chunks) > 0:
+			n := copy(b, s.chunks[0])
+			if n == len(s.chunks[0]) {
+				s.chunks = s.chunks[1:]
+			} else {
+				s.chunks[0] = s.chunks[0][n:]
+			}
+			s.mu.Unlock()
+			return n, nil
+		case s.eof:
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		if err := s.waitLocked(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// waitLocked releases mu and blocks until the stream changes or its deadline passes.
+func (s *stream) waitLocked() error {
+	changed, deadline := s.changed, s.deadline
+	s.mu.Unlock()
+
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// sleep waits for d, or until the read deadline if that comes first.
+func (s *stream) sleep(d time.Duration) error {
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+
+	if !deadline.IsZero() && time.Until(deadline) < d {
+		time.Sleep(time.Until(deadline))
+		return os.ErrDeadlineExceeded
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func (s *stream) setDeadline(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	s.notify()
+}
+
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.notify()
+}
+
+func (s *stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eof = true
+	s.notify()
+}
+
+// Conn is one end of an in-memory connection. Faults apply to data flowing out
+// of it (FragmentWrites) or into it (DelayReads) and can be changed at any time.
+type Conn struct {
+	in, out *stream
+	local   net.Addr
+	remote  net.Addr
+
+	mu       sync.Mutex
+	fragment int
+	delay    time.Duration
+	closed   bool
+	// writeDeadline lives here, the out stream's deadline belongs to the peer's reads.
+	writeDeadline time.Time
+}
+
+// Pipe returns the two ends of an in-memory, full-duplex connection.
+func Pipe() (*Conn, *Conn) {
+	return PipeAddrs(pipeAddr("faultnet:a"), pipeAddr("faultnet:b"))
+}
+
+// PipeAddrs is Pipe with the addresses each end reports as its local address.
+func PipeAddrs(a, b net.Addr) (*Conn, *Conn) {
+	ab, ba := newStream(), newStream()
+	c1 := &Conn{in: ba, out: ab, local: a, remote: b}
+	c2 := &Conn{in: ab, out: ba, local: b, remote: a}
+	return c1, c2
+}
+
+// FragmentWrites splits every following write into chunks of at most n bytes,
+// each delivered by its own Read on the peer. Zero turns fragmentation off.
+func (c *Conn) FragmentWrites(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fragment = n
+}
+
+// DelayReads makes every following Read wait d before returning data.
+func (c *Conn) DelayReads(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay = d
+}
+
+// Reset aborts the connection: pending and later operations on both ends fail
+// with ErrReset, buffered data is lost.
+func (c *Conn) Reset() {
+	c.in.fail(ErrReset)
+	c.out.fail(ErrReset)
+}
+
+// CloseWrite shuts down the sending side, the peer reads io.EOF once it has
+// drained the buffered data.
+func (c *Conn) CloseWrite() error {
+	c.out.close()
+	return nil
+}
+
+// CloseRead shuts down the receiving side, Reads fail with io.EOF and the
+// peer's writes with ErrClosed.
+func (c *Conn) CloseRead() error {
+	c.in.close()
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, delay := c.closed, c.delay
+	c.mu.Unlock()
+	if closed {
+		return 0, ErrClosed
+	}
+
+	if delay > 0 {
+		if err := c.in.sleep(delay); err != nil {
+			return 0, err
+		}
+	}
+	return c.in.read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, fragment, deadline := c.closed, c.fragment, c.writeDeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, ErrClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if err := c.out.write(b, fragment); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.in.fail(ErrClosed)
+	c.out.close()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// Listener hands out the server ends of pipes created by Dial.
+type Listener struct {
+	// Server and Client, when set, are called with the ends of each new pipe so
+	// that faults can be set up before any data flows.
+	Server func(conn *Conn)
+	Client func(conn *Conn)
+
+	addr  net.Addr
+	connc chan *Conn
+	donec chan struct{}
+	once  sync.Once
+}
+
+// Listen returns a Listener reporting addr as its address.
+func Listen(addr string) *Listener {
+	return &Listener{
+		addr:  pipeAddr(addr),
+		connc: make(chan *Conn),
+		donec: make(chan struct{}),
+	}
+}
+
+// Dial connects to the listener, blocking until the connection is accepted.
+func (l *Listener) Dial() (*Conn, error) {
+	client, server := PipeAddrs(pipeAddr("faultnet:client"), l.addr)
+	if l.Server != nil {
+		l.Server(server)
+	}
+	if l.Client != nil {
+		l.Client(client)
+	}
+
+	select {
+	case l.connc <- server:
+		return client, nil
+	case <-l.donec:
+		return nil, ErrClosed
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connc:
+		return conn, nil
+	case <-l.donec:
+		return nil, ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.donec) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
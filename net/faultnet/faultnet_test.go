@@ -0,0 +1,211 @@
+package faultnet
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFragmentWrites(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	a.FragmentWrites(3)
+	if n, err := a.Write([]byte("abcdefgh")); n != 8 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	for _, want := range []string{"abc", "def", "gh"} {
+		buf := make([]byte, 16)
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("bad: %q, expected %q", buf[:n], want)
+		}
+	}
+
+	// Short reads keep the rest of the chunk.
+	a.FragmentWrites(0)
+	a.Write([]byte("ijkl"))
+	buf := make([]byte, 3)
+	if n, _ := b.Read(buf); string(buf[:n]) != "ijk" {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+	if n, _ := b.Read(buf); string(buf[:n]) != "l" {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
+
+func TestDelayReads(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	b.DelayReads(50 * time.Millisecond)
+	a.Write([]byte("ping"))
+	start := time.Now()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("read returned after %v", elapsed)
+	}
+
+	// The delay doesn't outlast the read deadline.
+	b.DelayReads(time.Minute)
+	a.Write([]byte("ping"))
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := b.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	a.Write([]byte("lost"))
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := a.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	a.Reset()
+
+	if err := <-readErr; err != ErrReset {
+		t.Fatalf("expected ErrReset on the pending read, got: %v", err)
+	}
+	if _, err := b.Read(make([]byte, 4)); err != ErrReset {
+		t.Fatalf("expected ErrReset on the peer, got: %v", err)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrReset {
+		t.Fatalf("expected ErrReset on write, got: %v", err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	a.Write([]byte("ping"))
+	if err := a.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after CloseWrite, got: %v", err)
+	}
+	// The buffered data is drained before io.EOF.
+	recv, err := io.ReadAll(b)
+	if err != nil || string(recv) != "ping" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+
+	// The other direction stays open.
+	b.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(a, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+
+	if err := a.CloseRead(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF after CloseRead, got: %v", err)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed writing to a closed reader, got: %v", err)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := b.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("read returned after %v", elapsed)
+	}
+
+	// Moving the deadline wakes a pending read.
+	b.SetReadDeadline(time.Time{})
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.SetReadDeadline(time.Now())
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected a deadline error, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending read not woken by the deadline")
+	}
+
+	a.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := a.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got: %v", err)
+	}
+	a.SetDeadline(time.Time{})
+	if _, err := a.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	l := Listen("faultnet:server")
+	l.Server = func(conn *Conn) { conn.FragmentWrites(1) }
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("err: %v", err)
+			close(accepted)
+			return
+		}
+		accepted <- conn.(*Conn)
+	}()
+	client, err := l.Dial()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	if server.LocalAddr().String() != "faultnet:server" || client.RemoteAddr().String() != "faultnet:server" {
+		t.Fatalf("bad: %v %v", server.LocalAddr(), client.RemoteAddr())
+	}
+	server.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if n, _ := client.Read(buf); n != 1 {
+		t.Fatalf("expected a fragmented write, read %d bytes", n)
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+	if _, err := l.Dial(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got: %v", err)
+	}
+}
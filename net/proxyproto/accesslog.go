@@ -0,0 +1,348 @@
+package proxyproto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var pp2TypeNames = map[PP2Type]string{
+	PP2_TYPE_ALPN:           "ALPN",
+	PP2_TYPE_AUTHORITY:      "AUTHORITY",
+	PP2_TYPE_CRC32C:         "CRC32C",
+	PP2_TYPE_NOOP:           "NOOP",
+	PP2_TYPE_UNIQUE_ID:      "UNIQUE_ID",
+	PP2_TYPE_SSL:            "SSL",
+	PP2_SUBTYPE_SSL_VERSION: "SSL_VERSION",
+	PP2_SUBTYPE_SSL_CN:      "SSL_CN",
+	PP2_SUBTYPE_SSL_CIPHER:  "SSL_CIPHER",
+	PP2_SUBTYPE_SSL_SIG_ALG: "SSL_SIG_ALG",
+	PP2_SUBTYPE_SSL_KEY_ALG: "SSL_KEY_ALG",
+	PP2_TYPE_NETNS:          "NETNS",
+}
+
+func (t PP2Type) String() string {
+	if name, ok := pp2TypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+var transportProtocolNames = map[AddressFamilyAndProtocol]string{
+	UNSPEC:       "UNSPEC",
+	TCPv4:        "TCP4",
+	UDPv4:        "UDP4",
+	TCPv6:        "TCP6",
+	UDPv6:        "UDP6",
+	UnixStream:   "UNIX_STREAM",
+	UnixDatagram: "UNIX_DGRAM",
+}
+
+// AccessLogEntry is the record of one connection, written as a JSON line.
+type AccessLogEntry struct {
+	ID       string    `json:"id"`
+	Accepted time.Time `json:"accepted"`
+	Closed   time.Time `json:"closed"`
+
+	// Version, Command and Family describe the PROXY header, they are empty when
+	// the connection had none.
+	Version     byte       `json:"version,omitempty"`
+	Command     string     `json:"command,omitempty"`
+	Family      string     `json:"family,omitempty"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	TLVs        []TLVEntry `json:"tlvs,omitempty"`
+
+	// BytesIn and BytesOut count the payload read from and written to the client.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// CloseReason is "closed" when the server closed the connection, "eof" when
+	// the client did, and otherwise the error that ended it.
+	CloseReason string `json:"close_reason"`
+}
+
+// TLVEntry is a decoded TLV. Printable values are kept as text, others are hex
+// encoded; SSL TLVs have their sub-TLVs decoded.
+type TLVEntry struct {
+	Type  string     `json:"type"`
+	Value string     `json:"value"`
+	Sub   []TLVEntry `json:"sub,omitempty"`
+}
+
+func decodeTLVs(tlvs []TLV) []TLVEntry {
+	var entries []TLVEntry
+	for _, tlv := range tlvs {
+		entry := TLVEntry{Type: tlv.Type.String(), Value: formatTLVValue(tlv.Value)}
+		// The SSL TLV starts with a client byte and a 4-byte verify field.
+		if tlv.Type == PP2_TYPE_SSL && len(tlv.Value) >= 5 {
+			entry.Value = hex.EncodeToString(tlv.Value[:5])
+			if sub, err := SplitTLVs(tlv.Value[5:]); err == nil {
+				entry.Sub = decodeTLVs(sub)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func formatTLVValue(value []byte) string {
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(value)
+		}
+	}
+	return string(value)
+}
+
+// AccessLog writes an AccessLogEntry for every connection of a Listener once it
+// closes, health checks excepted.
+type AccessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLog returns an AccessLog writing to w, see RotatingFile.
+func NewAccessLog(w io.Writer) *AccessLog {
+	return &AccessLog{w: w}
+}
+
+// Write writes entry as one JSON line.
+func (a *AccessLog) Write(entry *AccessLogEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(append(b, '\n'))
+	return err
+}
+
+// connAccess gathers the access log entry of a connection.
+type connAccess struct {
+	log      *AccessLog
+	accepted time.Time
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu         sync.Mutex
+	headerDone bool
+	header     *Header
+	reason     error
+	once       sync.Once
+}
+
+func newConnAccess(log *AccessLog) *connAccess {
+	return &connAccess{log: log, accepted: time.Now()}
+}
+
+// headerRead records the outcome of reading the header.
+func (a *connAccess) headerRead(header *Header, err error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.headerDone, a.header = true, header
+	if err != nil && err != ErrNoProxyProtocol && a.reason == nil {
+		a.reason = err
+	}
+}
+
+// read and write count payload bytes and keep the first error as close reason.
+func (a *connAccess) read(n int64, err error) {
+	if a == nil {
+		return
+	}
+	a.bytesIn.Add(n)
+	a.fail(err)
+}
+
+func (a *connAccess) write(n int64, err error) {
+	if a == nil {
+		return
+	}
+	a.bytesOut.Add(n)
+	a.fail(err)
+}
+
+func (a *connAccess) fail(err error) {
+	if a == nil || err == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.reason == nil {
+		a.reason = err
+	}
+}
+
+// finish writes the entry of conn, the first call wins. It doesn't wait for a
+// header that hasn't been read.
+func (a *connAccess) finish(conn *Conn) {
+	if a == nil {
+		return
+	}
+	a.once.Do(func() {
+		a.mu.Lock()
+		headerDone, header, reason := a.headerDone, a.header, a.reason
+		a.mu.Unlock()
+
+		if !headerDone {
+			conn.idOnce.Do(func() { conn.id = NewUniqueID() })
+		}
+		entry := &AccessLogEntry{
+			ID:          conn.ID(),
+			Accepted:    a.accepted,
+			Closed:      time.Now(),
+			Source:      logAddr(conn.Conn.RemoteAddr()),
+			Destination: logAddr(conn.Conn.LocalAddr()),
+			BytesIn:     a.bytesIn.Load(),
+			BytesOut:    a.bytesOut.Load(),
+			CloseReason: "closed",
+		}
+		if header != nil {
+			entry.Version = header.Version
+			entry.Command = "PROXY"
+			if header.Command.IsLocal() {
+				entry.Command = "LOCAL"
+			}
+			entry.Family = transportProtocolNames[header.TransportProtocol]
+			if !header.Command.IsLocal() {
+				entry.Source = logAddr(header.SourceAddr)
+				entry.Destination = logAddr(header.DestinationAddr)
+			}
+			if tlvs, err := header.TLVs(); err == nil {
+				entry.TLVs = decodeTLVs(tlvs)
+			}
+		}
+		switch {
+		case errors.Is(reason, io.EOF):
+			entry.CloseReason = "eof"
+		case reason != nil:
+			entry.CloseReason = reason.Error()
+		}
+
+		if err := a.log.Write(entry); err != nil {
+			log.Printf("access log: %v", err)
+		}
+	})
+}
+
+func logAddr(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// RotatingFile is an io.WriteCloser appending to a file, which is rotated once
+// it would grow past MaxSize: path becomes path.1, path.1 becomes path.2, and so
+// on up to MaxBackups, the oldest being removed.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// OpenRotatingFile opens, or creates, the file at path for appending.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past MaxSize. A
+// single write is never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to the first backup and opens a new one. When that
+// fails the file is reopened for appending, so the log carries on and only the
+// write which triggered the rotation fails.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	err := f.shift()
+	if openErr := f.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (f *RotatingFile) shift() error {
+	if f.maxBackups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || f.file == nil {
+		f.closed = true
+		return nil
+	}
+	err := f.file.Close()
+	f.file, f.closed = nil, true
+	return err
+}
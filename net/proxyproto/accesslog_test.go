@@ -0,0 +1,198 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries waits for n entries to be logged and decodes them.
+func (b *syncBuffer) entries(t *testing.T, n int) []AccessLogEntry {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		lines := strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+		b.mu.Unlock()
+		if len(lines) >= n && lines[0] != "" {
+			var entries []AccessLogEntry
+			for _, line := range lines {
+				var entry AccessLogEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("err: %v: %s", err, line)
+				}
+				entries = append(entries, entry)
+			}
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d entries, got %q", n, lines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf syncBuffer
+	acl := NewACL(nil)
+	acl.SetRules([]*ACLRule{{Action: ACLDeny, Prefix: netip.MustParsePrefix("30.3.3.3/32")}})
+	pl := &Listener{Listener: l, AccessLog: NewAccessLog(&buf), HealthCheck: IgnoreHealthCheck, ACL: acl}
+	defer pl.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	ssl, _ := JoinTLVs([]TLV{{PP2_SUBTYPE_SSL_CN, []byte("client")}})
+	ssl = append([]byte{pp2ClientSSL, 0, 0, 0, 0}, ssl...)
+
+	go func() {
+		for _, header := range [][]byte{
+			[]byte("PROXY UNKNOWN\r\n"),
+			[]byte("PROXY TCP4 30.3.3.3 20.2.2.2 1000 2000\r\n"),
+			testV2Header(src, dst, TLV{PP2_TYPE_AUTHORITY, []byte("example.com")}, TLV{PP2_TYPE_SSL, ssl}),
+		} {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			conn.Write(append(header, "ping"...))
+			if bytes.HasPrefix(header, SIGV2) {
+				io.ReadFull(conn, make([]byte, 5))
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	io.ReadFull(conn, make([]byte, 4))
+	conn.Write([]byte("pong!"))
+	io.ReadAll(conn)
+	conn.Close()
+
+	// The health check isn't logged, the denied connection is.
+	entries := buf.entries(t, 2)
+	if len(entries) != 2 {
+		t.Fatalf("bad: %+v", entries)
+	}
+	denied, entry := entries[0], entries[1]
+	if denied.Source != "30.3.3.3:1000" || denied.CloseReason != ErrACLDenied.Error() || denied.Version != 1 {
+		t.Fatalf("bad: %+v", denied)
+	}
+
+	if entry.Version != 2 || entry.Command != "PROXY" || entry.Family != "TCP4" {
+		t.Fatalf("bad: %+v", entry)
+	}
+	if entry.Source != "10.1.1.1:1000" || entry.Destination != "20.2.2.2:2000" {
+		t.Fatalf("bad: %+v", entry)
+	}
+	if entry.BytesIn != 4 || entry.BytesOut != 5 || entry.CloseReason != "eof" {
+		t.Fatalf("bad: %+v", entry)
+	}
+	if entry.ID == "" || entry.Accepted.IsZero() || entry.Closed.Before(entry.Accepted) {
+		t.Fatalf("bad: %+v", entry)
+	}
+	tlvs := fmt.Sprint(entry.TLVs)
+	if tlvs != "[{AUTHORITY example.com []} {SSL 0100000000 [{SSL_CN client []}]}]" {
+		t.Fatalf("bad: %s", tlvs)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	f.Close()
+
+	for name, content := range map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil || string(b) != content {
+			t.Fatalf("%s: bad: %q %v", name, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected no third backup: %v", err)
+	}
+
+	// Reopening appends to the current file.
+	f, err = OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Write([]byte("e\n"))
+	f.Close()
+	if b, _ := os.ReadFile(path); string(b) != "dddddd\ne\n" {
+		t.Fatalf("bad: %q", b)
+	}
+}
+
+func TestRotatingFileRotateFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+	// A non-empty directory in place of the backup makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := f.Write([]byte("aaaaaa\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n, err := f.Write([]byte("bbbbbb\n")); n != 0 || err == nil {
+		t.Fatalf("expected the rotation to fail: %d %v", n, err)
+	}
+
+	// Later writes go on once the backup path is free again.
+	os.RemoveAll(path + ".1")
+	if _, err := f.Write([]byte("cccccc\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for name, content := range map[string]string{
+		path:        "cccccc\n",
+		path + ".1": "aaaaaa\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil || string(b) != content {
+			t.Fatalf("%s: bad: %q %v", name, b, err)
+		}
+	}
+}
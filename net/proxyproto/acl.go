@@ -0,0 +1,212 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrInvalidACLRule = errors.New("proxyproto: invalid ACL rule")
+	ErrACLDenied      = errors.New("proxyproto: source denied by ACL")
+)
+
+// ACLAction is what an ACL does with the connections a rule matches.
+type ACLAction int
+
+const (
+	ACLAllow ACLAction = iota
+	ACLDeny
+)
+
+func (a ACLAction) String() string {
+	if a == ACLDeny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// ACLRule allows or denies the sources within Prefix.
+type ACLRule struct {
+	Action ACLAction
+	Prefix netip.Prefix
+
+	hits atomic.Uint64
+}
+
+// Hits returns the number of connections the rule matched.
+func (r *ACLRule) Hits() uint64 {
+	return r.hits.Load()
+}
+
+func (r *ACLRule) String() string {
+	return r.Action.String() + " " + r.Prefix.String()
+}
+
+// ParseACLRules reads rules, one per line, in the form "allow 10.0.0.0/8" or
+// "deny 2001:db8::1". Blank lines and lines starting with # are skipped.
+func ParseACLRules(r io.Reader) ([]*ACLRule, error) {
+	var rules []*ACLRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseACLRule(line string) (*ACLRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return nil, ErrInvalidACLRule
+	}
+
+	rule := &ACLRule{}
+	switch fields[0] {
+	case "allow":
+		rule.Action = ACLAllow
+	case "deny":
+		rule.Action = ACLDeny
+	default:
+		return nil, ErrInvalidACLRule
+	}
+
+	if strings.Contains(fields[1], "/") {
+		prefix, err := netip.ParsePrefix(fields[1])
+		if err != nil {
+			return nil, ErrInvalidACLRule
+		}
+		rule.Prefix = prefix.Masked()
+	} else {
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil || addr.Zone() != "" {
+			return nil, ErrInvalidACLRule
+		}
+		rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return rule, nil
+}
+
+// ACL allows or denies connections by their source address, which is the one of
+// the PROXY header when there is one. Rules are evaluated in order and the first
+// one holding the source decides; Default decides for the rest, and for sources
+// that aren't IP addresses.
+type ACL struct {
+	Default ACLAction
+
+	path        string
+	mu          sync.RWMutex
+	rules       []*ACLRule
+	defaultHits atomic.Uint64
+}
+
+// NewACL returns an ACL evaluating rules.
+func NewACL(rules []*ACLRule) *ACL {
+	acl := &ACL{}
+	acl.SetRules(rules)
+	return acl
+}
+
+// LoadACL returns an ACL evaluating the rules of the file at path, which Reload
+// reads again.
+func LoadACL(path string) (*ACL, error) {
+	acl := &ACL{path: path}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Reload replaces the rules with those of the file the ACL was loaded from. The
+// current rules are kept when the file can't be read or parsed.
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return errors.New("proxyproto: ACL has no rules file")
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := ParseACLRules(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.SetRules(rules)
+	return nil
+}
+
+// SetRules replaces the rules. Rules equal to a current one keep its hit count.
+func (a *ACL) SetRules(rules []*ACLRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	previous := make(map[string]*ACLRule, len(a.rules))
+	for _, rule := range a.rules {
+		if _, ok := previous[rule.String()]; !ok {
+			previous[rule.String()] = rule
+		}
+	}
+	for _, rule := range rules {
+		if old, ok := previous[rule.String()]; ok {
+			rule.hits.Store(old.Hits())
+			delete(previous, rule.String())
+		}
+	}
+	a.rules = rules
+}
+
+// Rules returns the current rules, in evaluation order.
+func (a *ACL) Rules() []*ACLRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]*ACLRule(nil), a.rules...)
+}
+
+// DefaultHits returns the number of connections no rule matched.
+func (a *ACL) DefaultHits() uint64 {
+	return a.defaultHits.Load()
+}
+
+// Allow reports whether connections from addr are allowed.
+func (a *ACL) Allow(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.Prefix.Contains(addr) {
+			rule.hits.Add(1)
+			return rule.Action == ACLAllow
+		}
+	}
+	a.defaultHits.Add(1)
+	return a.Default == ACLAllow
+}
+
+// allowConn reports whether the source of conn is allowed.
+func (a *ACL) allowConn(conn *Conn) bool {
+	src, ok := conn.RemoteAddrPort()
+	if !ok {
+		a.defaultHits.Add(1)
+		return a.Default == ACLAllow
+	}
+	return a.Allow(src.Addr())
+}
@@ -0,0 +1,135 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	rules, err := ParseACLRules(strings.NewReader(`
+# office
+deny 10.1.0.0/16
+allow 10.0.0.0/8
+allow 2001:db8::1
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	acl := NewACL(rules)
+	acl.Default = ACLDeny
+
+	for addr, allowed := range map[string]bool{
+		"10.2.3.4":           true,
+		"10.1.2.3":           false,
+		"::ffff:10.2.3.4":    true,
+		"2001:db8::1":        true,
+		"2001:db8::2":        false,
+		"192.168.1.1":        false,
+		"fe80::1%eth0":       false,
+		"::ffff:192.168.1.1": false,
+	} {
+		if acl.Allow(netip.MustParseAddr(addr)) != allowed {
+			t.Fatalf("%s: expected allowed=%v", addr, allowed)
+		}
+	}
+
+	hits := map[string]uint64{}
+	for _, rule := range acl.Rules() {
+		hits[rule.String()] = rule.Hits()
+	}
+	if hits["deny 10.1.0.0/16"] != 1 || hits["allow 10.0.0.0/8"] != 2 || hits["allow 2001:db8::1/128"] != 1 {
+		t.Fatalf("bad hits: %v", hits)
+	}
+	if acl.DefaultHits() != 4 {
+		t.Fatalf("bad default hits: %d", acl.DefaultHits())
+	}
+
+	for _, line := range []string{"allow", "permit 10.0.0.0/8", "deny 10.0.0.0/33", "allow fe80::1%eth0"} {
+		if _, err := ParseACLRules(strings.NewReader(line)); !errors.Is(err, ErrInvalidACLRule) {
+			t.Fatalf("%q: expected invalid rule, got: %v", line, err)
+		}
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	os.WriteFile(path, []byte("allow 10.0.0.0/8\n"), 0o644)
+
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	acl.Default = ACLDeny
+	if !acl.Allow(netip.MustParseAddr("10.1.1.1")) || acl.Allow(netip.MustParseAddr("20.2.2.2")) {
+		t.Fatal("bad initial rules")
+	}
+
+	os.WriteFile(path, []byte("allow 10.0.0.0/8\nallow 20.0.0.0/8\n"), 0o644)
+	if err := acl.Reload(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !acl.Allow(netip.MustParseAddr("20.2.2.2")) {
+		t.Fatal("reloaded rule not applied")
+	}
+	// Unchanged rules keep their counters.
+	if rules := acl.Rules(); rules[0].Hits() != 1 || rules[1].Hits() != 1 {
+		t.Fatalf("bad hits: %d %d", rules[0].Hits(), rules[1].Hits())
+	}
+
+	// A broken file leaves the current rules in place.
+	os.WriteFile(path, []byte("allow everyone\n"), 0o644)
+	if err := acl.Reload(); !errors.Is(err, ErrInvalidACLRule) {
+		t.Fatalf("expected invalid rule, got: %v", err)
+	}
+	if len(acl.Rules()) != 2 {
+		t.Fatalf("bad: %v", acl.Rules())
+	}
+}
+
+func TestListenerACL(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		rules, _ := ParseACLRules(strings.NewReader("deny 10.0.0.0/8"))
+		metrics := &Metrics{}
+		pl := &Listener{Listener: l, ACL: NewACL(rules), HeaderWorkers: workers, Metrics: metrics}
+
+		for _, header := range []string{
+			"PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+			"PROXY TCP4 30.3.3.3 20.2.2.2 1000 2000\r\n",
+		} {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(header))
+		}
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if conn.RemoteAddr().String() != "30.3.3.3:1000" {
+			t.Fatalf("workers=%d: bad: %v", workers, conn.RemoteAddr())
+		}
+		conn.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for metrics.ACLDenied.Load() != 1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if metrics.ACLDenied.Load() != 1 {
+			t.Fatalf("workers=%d: bad denied count: %d", workers, metrics.ACLDenied.Load())
+		}
+		pl.Close()
+	}
+}
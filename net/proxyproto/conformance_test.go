@@ -0,0 +1,172 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// conformanceCorpusVersion is the corpus format understood by these tests, bump it
+// together with the files under testdata/conformance when the format changes.
+const conformanceCorpusVersion = 1
+
+type conformanceCorpus struct {
+	CorpusVersion int               `json:"corpus_version"`
+	Cases         []conformanceCase `json:"cases"`
+}
+
+type conformanceCase struct {
+	Name   string             `json:"name"`
+	Text   string             `json:"text"`
+	Hex    string             `json:"hex"`
+	Header *conformanceHeader `json:"header"`
+	Error  string             `json:"error"`
+}
+
+type conformanceHeader struct {
+	Version     byte   `json:"version"`
+	Command     string `json:"command"`
+	Transport   string `json:"transport"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	TLVs        []struct {
+		Type  PP2Type `json:"type"`
+		Value string  `json:"value"`
+	} `json:"tlvs"`
+}
+
+var conformanceErrors = map[string]error{
+	"ErrCantReadVersion1Header":               ErrCantReadVersion1Header,
+	"ErrVersion1HeaderTooLong":                ErrVersion1HeaderTooLong,
+	"ErrLineMustEndWithCrlf":                  ErrLineMustEndWithCrlf,
+	"ErrCantReadProtocolVersionAndCommand":    ErrCantReadProtocolVersionAndCommand,
+	"ErrCantReadAddressFamilyAndProtocol":     ErrCantReadAddressFamilyAndProtocol,
+	"ErrCantReadLength":                       ErrCantReadLength,
+	"ErrNoProxyProtocol":                      ErrNoProxyProtocol,
+	"ErrUnsupportedProtocolVersionAndCommand": ErrUnsupportedProtocolVersionAndCommand,
+	"ErrUnsupportedAddressFamilyAndProtocol":  ErrUnsupportedAddressFamilyAndProtocol,
+	"ErrInvalidLength":                        ErrInvalidLength,
+	"ErrInvalidAddress":                       ErrInvalidAddress,
+	"ErrInvalidPortNumber":                    ErrInvalidPortNumber,
+}
+
+var conformanceCommands = map[string]ProtocolVersionAndCommand{
+	"LOCAL": LOCAL,
+	"PROXY": PROXY,
+}
+
+var conformanceTransports = map[string]AddressFamilyAndProtocol{
+	"UNSPEC":       UNSPEC,
+	"TCPv4":        TCPv4,
+	"UDPv4":        UDPv4,
+	"TCPv6":        TCPv6,
+	"UDPv6":        UDPv6,
+	"UnixStream":   UnixStream,
+	"UnixDatagram": UnixDatagram,
+}
+
+func loadConformanceCases(t testing.TB) []conformanceCase {
+	files, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.json"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var cases []conformanceCase
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var corpus conformanceCorpus
+		if err := json.Unmarshal(b, &corpus); err != nil {
+			t.Fatalf("%s: err: %v", file, err)
+		}
+		if corpus.CorpusVersion != conformanceCorpusVersion {
+			t.Fatalf("%s: unsupported corpus version %d", file, corpus.CorpusVersion)
+		}
+		cases = append(cases, corpus.Cases...)
+	}
+	if len(cases) == 0 {
+		t.Fatal("empty conformance corpus")
+	}
+	return cases
+}
+
+func (c conformanceCase) input(t testing.TB) []byte {
+	if c.Hex == "" {
+		return []byte(c.Text)
+	}
+	b, err := hex.DecodeString(c.Hex)
+	if err != nil {
+		t.Fatalf("%s: err: %v", c.Name, err)
+	}
+	return b
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range loadConformanceCases(t) {
+		if c.Error != "" {
+			_, err := Read(bufio.NewReader(bytes.NewReader(c.input(t))))
+			want, ok := conformanceErrors[c.Error]
+			if !ok {
+				t.Fatalf("%s: unknown error %q", c.Name, c.Error)
+			}
+			if !errors.Is(err, want) {
+				t.Errorf("%s: expected %v, got %v", c.Name, want, err)
+			}
+			continue
+		}
+
+		// Valid headers are followed by payload that must be left unread.
+		payload := []byte("HELO")
+		reader := bufio.NewReader(bytes.NewReader(append(c.input(t), payload...)))
+		header, err := Read(reader)
+		if err != nil {
+			t.Errorf("%s: err: %v", c.Name, err)
+			continue
+		}
+		if rest, _ := reader.Peek(len(payload)); !bytes.Equal(rest, payload) {
+			t.Errorf("%s: header consumed payload bytes, left %q", c.Name, rest)
+		}
+		if !bytes.Equal(header.Raw(), c.input(t)) {
+			t.Errorf("%s: bad raw header: %q", c.Name, header.Raw())
+		}
+
+		want := c.Header
+		if header.Version != want.Version {
+			t.Errorf("%s: bad version: %d", c.Name, header.Version)
+		}
+		if header.Command != conformanceCommands[want.Command] {
+			t.Errorf("%s: bad command: %#x", c.Name, byte(header.Command))
+		}
+		if header.TransportProtocol != conformanceTransports[want.Transport] {
+			t.Errorf("%s: bad transport: %#x", c.Name, byte(header.TransportProtocol))
+		}
+		if want.Source != "" && addrString(header.SourceAddr) != want.Source {
+			t.Errorf("%s: bad source: %s", c.Name, addrString(header.SourceAddr))
+		}
+		if want.Destination != "" && addrString(header.DestinationAddr) != want.Destination {
+			t.Errorf("%s: bad destination: %s", c.Name, addrString(header.DestinationAddr))
+		}
+
+		tlvs, err := header.TLVs()
+		if err != nil {
+			t.Errorf("%s: err: %v", c.Name, err)
+			continue
+		}
+		if len(tlvs) != len(want.TLVs) {
+			t.Errorf("%s: expected %d TLVs, got %d", c.Name, len(want.TLVs), len(tlvs))
+			continue
+		}
+		for i, tlv := range tlvs {
+			if tlv.Type != want.TLVs[i].Type || hex.EncodeToString(tlv.Value) != want.TLVs[i].Value {
+				t.Errorf("%s: bad TLV %d: %v", c.Name, i, tlv)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrUnsupportedConnOperation = errors.New("proxyproto: operation not supported by the wrapped connection")
+)
+
+// WriteTo implements io.WriterTo. It writes the bytes buffered while reading the
+// header first, then hands the rest of the stream to w.ReadFrom with the wrapped
+// connection as source, which lets a *net.TCPConn destination splice it.
+func (p *Conn) WriteTo(w io.Writer) (int64, error) {
+	p.once.Do(func() { p.readErr = p.readHeader() })
+	if p.readErr != nil && p.readErr != ErrNoProxyProtocol {
+		return 0, p.readErr
+	}
+	p.waitAdmission()
+
+	var written int64
+	if buffered := p.bufReader.Buffered(); buffered > 0 {
+		b, _ := p.bufReader.Peek(buffered)
+		n, err := w.Write(b)
+		p.bufReader.Discard(n)
+		p.access.read(int64(n), nil)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	var n int64
+	var err error
+	if rf, ok := w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(p.socket())
+	} else {
+		n, err = io.Copy(w, p.socket())
+	}
+	if err == nil {
+		// Copying stops without error once the client is done sending.
+		p.access.read(n, io.EOF)
+	} else {
+		p.access.read(n, err)
+	}
+	return written + n, err
+}
+
+// ReadFrom implements io.ReaderFrom by writing straight to the wrapped
+// connection, the header only concerns the read side.
+func (p *Conn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := p.socket().(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(p.socket(), r)
+	}
+	p.access.write(n, err)
+	return n, err
+}
+
+// SetDeadline sets the read and write deadlines of the wrapped connection. The
+// read one is kept across the header read, see SetReadDeadline.
+func (p *Conn) SetDeadline(t time.Time) error {
+	p.deadlineMu.Lock()
+	defer p.deadlineMu.Unlock()
+	p.readDeadline = t
+	return p.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the wrapped connection. Reading the
+// header moves it temporarily, it is put back once the header is read.
+func (p *Conn) SetReadDeadline(t time.Time) error {
+	p.deadlineMu.Lock()
+	defer p.deadlineMu.Unlock()
+	p.readDeadline = t
+	return p.Conn.SetReadDeadline(t)
+}
+
+// setHeaderDeadline bounds the header read by timeout without going past the
+// read deadline set by the caller.
+func (p *Conn) setHeaderDeadline(timeout time.Duration) {
+	p.deadlineMu.Lock()
+	defer p.deadlineMu.Unlock()
+	deadline := time.Now().Add(timeout)
+	if !p.readDeadline.IsZero() && p.readDeadline.Before(deadline) {
+		deadline = p.readDeadline
+	}
+	p.Conn.SetReadDeadline(deadline)
+}
+
+// restoreReadDeadline puts back the read deadline set by the caller.
+func (p *Conn) restoreReadDeadline() {
+	p.deadlineMu.Lock()
+	defer p.deadlineMu.Unlock()
+	p.Conn.SetReadDeadline(p.readDeadline)
+}
+
+// socket returns the connection the stream is read from and written to, looking
+// through the wrappers of the middlewares which leave it untouched.
+func (p *Conn) socket() net.Conn {
+	return streamOf(p.Conn)
+}
+
+// Unwrap returns the wrapped connection, for options this type doesn't pass through.
+func (p *Conn) Unwrap() net.Conn {
+	return p.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection.
+func (p *Conn) CloseWrite() error {
+	if c, ok := p.socket().(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return ErrUnsupportedConnOperation
+}
+
+// CloseRead shuts down the reading side of the wrapped connection.
+func (p *Conn) CloseRead() error {
+	if c, ok := p.socket().(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (p *Conn) SetKeepAlive(keepalive bool) error {
+	if c, ok := p.socket().(interface{ SetKeepAlive(bool) error }); ok {
+		return c.SetKeepAlive(keepalive)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (p *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if c, ok := p.socket().(interface{ SetKeepAlivePeriod(time.Duration) error }); ok {
+		return c.SetKeepAlivePeriod(d)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (p *Conn) SetNoDelay(noDelay bool) error {
+	if c, ok := p.socket().(interface{ SetNoDelay(bool) error }); ok {
+		return c.SetNoDelay(noDelay)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (p *Conn) SetLinger(sec int) error {
+	if c, ok := p.socket().(interface{ SetLinger(int) error }); ok {
+		return c.SetLinger(sec)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (p *Conn) SetReadBuffer(bytes int) error {
+	if c, ok := p.socket().(interface{ SetReadBuffer(int) error }); ok {
+		return c.SetReadBuffer(bytes)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (p *Conn) SetWriteBuffer(bytes int) error {
+	if c, ok := p.socket().(interface{ SetWriteBuffer(int) error }); ok {
+		return c.SetWriteBuffer(bytes)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+// SyscallConn returns a raw network connection of the wrapped connection.
+func (p *Conn) SyscallConn() (syscall.RawConn, error) {
+	if c, ok := p.socket().(syscall.Conn); ok {
+		return c.SyscallConn()
+	}
+	return nil, ErrUnsupportedConnOperation
+}
@@ -0,0 +1,231 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gptlocal/wheels/net/faultnet"
+)
+
+func TestConnFragmentedHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	headers := map[string][]byte{
+		"v1": []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"),
+		"v2": testV2Header(src, dst, TLV{PP2_TYPE_AUTHORITY, []byte("example.com")}),
+	}
+
+	for name, header := range headers {
+		client, server := faultnet.Pipe()
+		client.FragmentWrites(1)
+		conn := NewConn(server)
+
+		go func() {
+			client.Write(header)
+			client.Write([]byte("ping"))
+		}()
+
+		recv := make([]byte, 4)
+		if _, err := io.ReadFull(conn, recv); err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+		if !bytes.Equal(recv, []byte("ping")) {
+			t.Fatalf("%s: bad: %q", name, recv)
+		}
+		if conn.RemoteAddr().String() != src.String() {
+			t.Fatalf("%s: bad remote address: %v", name, conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
+
+func TestConnSlowHeader(t *testing.T) {
+	client, server := faultnet.Pipe()
+	server.DelayReads(200 * time.Millisecond)
+	conn := NewConn(server)
+	conn.readHeaderTimeout = 50 * time.Millisecond
+	defer conn.Close()
+
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got: %v", err)
+	}
+	// The header deadline must not outlive the header.
+	if conn.RemoteAddr().String() == "10.1.1.1:1000" {
+		t.Fatal("header parsed despite the timeout")
+	}
+}
+
+func TestConnResetDuringHeader(t *testing.T) {
+	client, server := faultnet.Pipe()
+	conn := NewConn(server)
+	defer conn.Close()
+
+	client.Write([]byte("PROXY TCP4 10.1.1.1"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Reset()
+	}()
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, faultnet.ErrReset) {
+		t.Fatalf("expected reset, got: %v", err)
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+}
+
+func TestConnHalfClose(t *testing.T) {
+	client, server := faultnet.Pipe()
+	conn := NewConn(server)
+	defer conn.Close()
+
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+	client.CloseWrite()
+
+	recv, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %q", recv)
+	}
+
+	// The other direction stays open after the client's half-close.
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv = make([]byte, 4)
+	if _, err := io.ReadFull(client, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("pong")) {
+		t.Fatalf("bad: %q", recv)
+	}
+}
+
+func TestConnHeaderAccessors(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	raw := testV2Header(src, dst, TLV{PP2_TYPE_AUTHORITY, []byte("example.com")}, TLV{PP2_TYPE_UNIQUE_ID, []byte("42")})
+
+	client, server := faultnet.Pipe()
+	conn := NewConn(server)
+	defer conn.Close()
+	client.Write(append(append([]byte{}, raw...), "ping"...))
+
+	header := conn.ProxyHeader()
+	if header == nil || header.SourceAddr.String() != src.String() {
+		t.Fatalf("bad: %+v", header)
+	}
+	if !bytes.Equal(conn.RawHeader(), raw) {
+		t.Fatalf("bad: %q", conn.RawHeader())
+	}
+	if authority, ok := conn.TLV(PP2_TYPE_AUTHORITY); !ok || string(authority) != "example.com" {
+		t.Fatalf("bad: %q", authority)
+	}
+	if _, ok := conn.TLV(PP2_TYPE_ALPN); ok {
+		t.Fatal("unexpected ALPN TLV")
+	}
+
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %q", recv)
+	}
+}
+
+func TestConnWriteTo(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewConn(server)
+	defer conn.Close()
+
+	go func() {
+		client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+		client.Write([]byte("pong"))
+		client.Close()
+	}()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 8 || buf.String() != "pingpong" {
+		t.Fatalf("bad: %d %q", n, buf.String())
+	}
+	if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+}
+
+func TestConnPassthrough(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	accepted, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn := accepted.(*Conn)
+	defer conn.Close()
+
+	if _, ok := conn.Unwrap().(*net.TCPConn); !ok {
+		t.Fatalf("bad: %T", conn.Unwrap())
+	}
+	for name, err := range map[string]error{
+		"SetKeepAlive":       conn.SetKeepAlive(true),
+		"SetKeepAlivePeriod": conn.SetKeepAlivePeriod(time.Minute),
+		"SetNoDelay":         conn.SetNoDelay(true),
+		"SetLinger":          conn.SetLinger(0),
+	} {
+		if err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+	}
+	if _, err := conn.SyscallConn(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Half-close: the client still reads after the server stops writing.
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Write([]byte("pong"))
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv, err = io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("pong")) {
+		t.Fatalf("bad: %q", recv)
+	}
+
+	// Operations the wrapped connection lacks report so.
+	_, server := net.Pipe()
+	if err := NewConn(server).SetNoDelay(true); err != ErrUnsupportedConnOperation {
+		t.Fatalf("bad: %v", err)
+	}
+}
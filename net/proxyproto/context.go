@@ -0,0 +1,62 @@
+package proxyproto
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, setting it interrupts blocked reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReadContext reads the PROXY header of conn, if it hasn't been read yet, and
+// returns it. When ctx is done first the read is interrupted by moving the
+// connection's read deadline to the past, and the error wraps ctx.Err().
+func ReadContext(ctx context.Context, conn *Conn) (*Header, error) {
+	conn.once.Do(func() { conn.readErr = conn.readHeaderContext(ctx) })
+	if conn.readErr != nil {
+		return nil, conn.readErr
+	}
+	return conn.header, nil
+}
+
+// readLimitedContext reads the header until ctx or the connection's own context is done.
+func (p *Conn) readLimitedContext(ctx context.Context) (*Header, error) {
+	connCtx := p.ctx
+	if connCtx == nil {
+		connCtx = context.Background()
+	}
+	if ctx.Done() == nil && connCtx.Done() == nil {
+		return ReadLimited(p.bufReader, p.limits)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+		case <-connCtx.Done():
+		case <-done:
+			return
+		}
+		p.Conn.SetReadDeadline(aLongTimeAgo)
+	}()
+
+	header, err := ReadLimited(p.bufReader, p.limits)
+	close(done)
+	<-stopped
+
+	for _, c := range []context.Context{ctx, connCtx} {
+		if c.Err() == nil {
+			continue
+		}
+		// The deadline may have moved after the header was read, put it back.
+		p.restoreReadDeadline()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: header read interrupted: %w", c.Err())
+		}
+		break
+	}
+	return header, err
+}
@@ -0,0 +1,125 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gptlocal/wheels/net/faultnet"
+)
+
+func TestReadContextCanceled(t *testing.T) {
+	client, server := faultnet.Pipe()
+	conn := NewConn(server)
+	defer conn.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err := ReadContext(ctx, conn); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+	// The connection is still usable, e.g. to write an error response.
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	client, server := faultnet.Pipe()
+	conn := NewConn(server)
+	defer conn.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	header, err := ReadContext(ctx, conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header.SourceAddr.String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", header.SourceAddr)
+	}
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil || string(recv) != "ping" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+}
+
+func TestListenerCloseInterruptsHeaderReads(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	errc := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	pl.Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("header read not interrupted by Close")
+	}
+}
+
+func TestReadContextKeepsReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	go client.Write([]byte("PROXY TCP4 10.1.1.1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ReadContext(ctx, conn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Conn.Read(make([]byte, 1))
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("expected a timeout, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("read deadline not restored, read returned after %v", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read deadline cleared after the interrupted header read")
+	}
+}
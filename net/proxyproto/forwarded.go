@@ -0,0 +1,332 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pp2ClientSSL is the PP2_TYPE_SSL client flag telling the client connected over TLS.
+const pp2ClientSSL = 0x01
+
+// SetForwarded sets the RFC 7239 Forwarded and the X-Forwarded-For, -Proto,
+// -Host and -Port headers of out, a request proxied from in, replacing any the
+// client sent. When the peer of in is within trusted, the Forwarded and
+// X-Forwarded-For chains it sent are kept and this hop is appended to them. When
+// in was served over a PROXY Listener with ConnContext, they describe the
+// connection of the PROXY header: its source, its destination, and https when
+// the header's PP2_TYPE_SSL TLV says the client used TLS.
+func SetForwarded(out, in *http.Request, trusted []netip.Prefix) {
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	var by net.Addr
+	if conn, ok := ConnFromContext(in.Context()); ok {
+		if value, ok := conn.TLV(PP2_TYPE_SSL); ok && len(value) > 0 && value[0]&pp2ClientSSL != 0 {
+			proto = "https"
+		}
+		by = conn.LocalAddr()
+	} else if addr, ok := in.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		by = addr
+	}
+
+	forwarded := []string{"for=" + forwardedNode(in.RemoteAddr)}
+	if by != nil {
+		forwarded = append(forwarded, "by="+forwardedNode(by.String()))
+	}
+	if in.Host != "" {
+		forwarded = append(forwarded, "host="+quoteForwarded(in.Host))
+	}
+	forwarded = append(forwarded, "proto="+proto)
+	// The chains are read from in, a ReverseProxy has removed them from out.
+	peer, err := netip.ParseAddrPort(in.RemoteAddr)
+	chain := err == nil && trustedAddr(trusted, peer.Addr())
+	out.Header.Set("Forwarded", appendHop(in.Header, "Forwarded", strings.Join(forwarded, ";"), chain))
+
+	out.Header.Del("X-Forwarded-For")
+	if host, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		out.Header.Set("X-Forwarded-For", appendHop(in.Header, "X-Forwarded-For", host, chain))
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Del("X-Forwarded-Host")
+	if in.Host != "" {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+	out.Header.Del("X-Forwarded-Port")
+	if by != nil {
+		if _, port, err := net.SplitHostPort(by.String()); err == nil {
+			out.Header.Set("X-Forwarded-Port", port)
+		}
+	}
+}
+
+// appendHop returns hop appended to the comma separated values of name in
+// header when chain is set, hop alone otherwise.
+func appendHop(header http.Header, name, hop string, chain bool) string {
+	prior := header.Values(name)
+	if !chain || len(prior) == 0 {
+		return hop
+	}
+	return strings.Join(prior, ", ") + ", " + hop
+}
+
+// forwardedNode formats an address as a Forwarded node, "unknown" when it isn't
+// an IP one.
+func forwardedNode(hostport string) string {
+	addrPort, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return "unknown"
+	}
+	if addrPort.Addr().Is6() && !addrPort.Addr().Is4In6() {
+		return quoteForwarded("[" + addrPort.Addr().String() + "]:" + strconv.Itoa(int(addrPort.Port())))
+	}
+	return quoteForwarded(addrPort.Addr().Unmap().String() + ":" + strconv.Itoa(int(addrPort.Port())))
+}
+
+// quoteForwarded quotes a Forwarded value unless it is a token.
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// NewForwardedProxy returns a reverse proxy to target setting the Forwarded and
+// X-Forwarded-* headers of proxied requests with SetForwarded, keeping the chains
+// of peers within trusted. It is meant to be served over a PROXY Listener, with
+// ConnContext.
+func NewForwardedProxy(target *url.URL, trusted []netip.Prefix) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			SetForwarded(pr.Out, pr.In, trusted)
+		},
+	}
+}
+
+// ForwardedClient returns the client of r. Starting from the peer of r, it walks
+// back the hops of the Forwarded header, or of X-Forwarded-For when there is
+// none, for as long as the current hop is within trusted. Hops without a port
+// get port 0.
+func ForwardedClient(r *http.Request, trusted []netip.Prefix) (netip.AddrPort, bool) {
+	client, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0 && trustedAddr(trusted, client.Addr()); i-- {
+		hop, ok := parseForwardedNode(hops[i])
+		if !ok {
+			break
+		}
+		client = hop
+	}
+	return client, true
+}
+
+func trustedAddr(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= nodes of the Forwarded header, or the addresses
+// of X-Forwarded-For, from the client to the last proxy.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, line := range header.Values("Forwarded") {
+		for _, element := range splitQuoted(line, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+
+	for _, line := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s around sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseForwardedNode parses a Forwarded node or X-Forwarded-For address.
+// Obfuscated ports are read as 0, obfuscated and unknown addresses fail.
+func parseForwardedNode(node string) (netip.AddrPort, bool) {
+	node = strings.TrimSpace(node)
+	if unquoted, err := strconv.Unquote(node); err == nil {
+		node = unquoted
+	}
+	if strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		node = node[1 : len(node)-1]
+	}
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return netip.AddrPortFrom(addr, 0), true
+	}
+
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return netip.AddrPortFrom(addr, uint16(p)), true
+}
+
+type forwardedClientKey struct{}
+
+// ProxyHeaderTransport is a http.RoundTripper sending each request over its own
+// connection, which starts with a PROXY header describing the client found by
+// ForwardedClient. It lets an HTTP front end forward to backends reading PROXY
+// headers. Only the http scheme is supported.
+type ProxyHeaderTransport struct {
+	// Version is the PROXY header version, defaults to 2.
+	Version byte
+	// Trusted holds the proxies whose Forwarded and X-Forwarded-For headers are
+	// believed.
+	Trusted []netip.Prefix
+	// DialTimeout bounds connecting to a backend, zero means no limit.
+	DialTimeout time.Duration
+}
+
+// NewProxyHeaderProxy returns a reverse proxy to target sending requests with
+// transport.
+func NewProxyHeaderProxy(target *url.URL, transport *ProxyHeaderTransport) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			// The Forwarded headers of pr.Out are gone by now.
+			if client, ok := ForwardedClient(pr.In, transport.Trusted); ok {
+				pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), forwardedClientKey{}, client))
+			}
+		},
+		Transport: transport,
+	}
+}
+
+func (t *ProxyHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return nil, fmt.Errorf("proxyproto: unsupported scheme %q", req.URL.Scheme)
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	dialer := &net.Dialer{Timeout: t.DialTimeout}
+	conn, err := dialer.DialContext(req.Context(), "tcp", net.JoinHostPort(req.URL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	client, ok := req.Context().Value(forwardedClientKey{}).(netip.AddrPort)
+	if !ok {
+		client, ok = ForwardedClient(req, t.Trusted)
+	}
+	var src net.Addr = conn.LocalAddr()
+	if ok {
+		src = net.TCPAddrFromAddrPort(client)
+	}
+	dst, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		dst = conn.RemoteAddr()
+	}
+	version := t.Version
+	if version == 0 {
+		version = 2
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}
+	go func() {
+		select {
+		case <-req.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := HeaderFromAddrs(version, src, dst).WriteTo(conn); err != nil {
+		closeConn()
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.Close = true
+	if err := out.Write(conn); err != nil {
+		closeConn()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		closeConn()
+		return nil, err
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, close: closeConn}
+	return resp, nil
+}
+
+// connBody closes the connection of a response along with its body.
+type connBody struct {
+	io.ReadCloser
+	close func()
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.close()
+	return err
+}
@@ -0,0 +1,161 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestForwardedProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port"} {
+			w.Header().Set("Echo-"+name, r.Header.Get(name))
+		}
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server := &http.Server{Handler: NewForwardedProxy(target, nil), ConnContext: ConnContext}
+	go server.Serve(&Listener{Listener: l})
+	defer server.Close()
+
+	header := HeaderFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443})
+	header.SetTLVs([]TLV{{PP2_TYPE_SSL, []byte{pp2ClientSSL, 0, 0, 0, 0}}})
+	raw, err := header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(raw)
+	// Headers sent by the client are replaced.
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 6.6.6.6\r\nForwarded: for=6.6.6.6\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+
+	expected := map[string]string{
+		"Forwarded":         `for="[2001:db8::1]:1000";by="[2001:db8::2]:443";host=example.com;proto=https`,
+		"X-Forwarded-For":   "2001:db8::1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Port":  "443",
+	}
+	for name, value := range expected {
+		if got := resp.Header.Get("Echo-" + name); got != value {
+			t.Fatalf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+}
+
+func TestSetForwardedChain(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		peer      string
+		forwarded string
+		xff       string
+	}{
+		{"10.0.0.1:1000", `for=1.1.1.1, for=2.2.2.2;proto=http, for="10.0.0.1:1000";host=example.com;proto=http`, "1.1.1.1, 2.2.2.2, 10.0.0.1"},
+		// Untrusted peers may have made the chain up.
+		{"6.6.6.6:1000", `for="6.6.6.6:1000";host=example.com;proto=http`, "6.6.6.6"},
+	}
+
+	for _, tt := range tests {
+		in := httptest.NewRequest("GET", "http://example.com/", nil)
+		in.RemoteAddr = tt.peer
+		in.Header.Add("Forwarded", "for=1.1.1.1")
+		in.Header.Add("Forwarded", "for=2.2.2.2;proto=http")
+		in.Header.Add("X-Forwarded-For", "1.1.1.1")
+		in.Header.Add("X-Forwarded-For", "2.2.2.2")
+		out := in.Clone(in.Context())
+
+		SetForwarded(out, in, trusted)
+		if got := out.Header.Values("Forwarded"); len(got) != 1 || got[0] != tt.forwarded {
+			t.Fatalf("%s: bad Forwarded: %q", tt.peer, got)
+		}
+		if got := out.Header.Values("X-Forwarded-For"); len(got) != 1 || got[0] != tt.xff {
+			t.Fatalf("%s: bad X-Forwarded-For: %q", tt.peer, got)
+		}
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		client     string
+	}{
+		{"untrusted peer", "192.0.2.1:1000", http.Header{"Forwarded": {"for=198.51.100.1"}}, "192.0.2.1:1000"},
+		{"no header", "127.0.0.1:1000", http.Header{}, "127.0.0.1:1000"},
+		{"forwarded", "127.0.0.1:1000", http.Header{"Forwarded": {`for=198.51.100.1;proto=http, for="[2001:db8::1]:4711"`}}, "198.51.100.1:0"},
+		{"stops at untrusted hop", "127.0.0.1:1000", http.Header{"Forwarded": {`for=198.51.100.1, for="192.0.2.9:80"`}}, "192.0.2.9:80"},
+		{"obfuscated hop", "127.0.0.1:1000", http.Header{"Forwarded": {"for=_hidden"}}, "127.0.0.1:1000"},
+		{"x-forwarded-for", "127.0.0.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.1, 2001:db8::1"}}, "198.51.100.1:0"},
+	}
+
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+		client, ok := ForwardedClient(r, trusted)
+		if !ok || client.String() != tt.client {
+			t.Fatalf("%s: expected %s, got %v", tt.name, tt.client, client)
+		}
+	}
+}
+
+func TestProxyHeaderProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go backend.Serve(&Listener{Listener: l})
+	defer backend.Close()
+
+	target, _ := url.Parse("http://" + l.Addr().String())
+	front := httptest.NewServer(NewProxyHeaderProxy(target, &ProxyHeaderTransport{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}))
+	defer front.Close()
+
+	for header, client := range map[string]string{
+		"for=198.51.100.1": "198.51.100.1:0",
+		"":                 "127.0.0.1",
+	} {
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		if header != "" {
+			req.Header.Set("Forwarded", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if header != "" && string(body) != client {
+			t.Fatalf("%q: expected %s, got %s", header, client, body)
+		}
+		if host, _, _ := net.SplitHostPort(string(body)); header == "" && host != client {
+			t.Fatalf("%q: expected %s, got %s", header, client, body)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	maxVersion1HeaderLength = 107
+	// fuzzReaderSize is the buffer size of the fuzzed readers, v2 payloads are
+	// peeked so it bounds them too.
+	fuzzReaderSize = 4096
+)
+
+// maxVersion2HeaderLength returns how many bytes a v2 header at the start of
+// data may take: its fixed part and the length it declares, as far as the
+// reader buffers it.
+func maxVersion2HeaderLength(data []byte) int {
+	if len(data) < 16 {
+		return 16
+	}
+	length := int(binary.BigEndian.Uint16(data[14:16]))
+	if length > fuzzReaderSize {
+		length = fuzzReaderSize
+	}
+	return 16 + length
+}
+
+// fuzzParser parses data with parse and returns the header and how many bytes it consumed.
+func fuzzParser(parse func(*bufio.Reader) (*Header, error), data []byte) (*Header, int, error) {
+	source := bytes.NewReader(data)
+	reader := bufio.NewReaderSize(source, fuzzReaderSize)
+	header, err := parse(reader)
+	return header, len(data) - source.Len() - reader.Buffered(), err
+}
+
+func sameHeader(a, b *Header) bool {
+	return a.Version == b.Version &&
+		a.Command == b.Command &&
+		a.TransportProtocol == b.TransportProtocol &&
+		addrString(a.SourceAddr) == addrString(b.SourceAddr) &&
+		addrString(a.DestinationAddr) == addrString(b.DestinationAddr) &&
+		bytes.Equal(a.rawTLVs, b.rawTLVs)
+}
+
+// fuzzHeader checks that parse doesn't read past max bytes and that parsing the
+// bytes it consumed again gives the same header.
+func fuzzHeader(t *testing.T, parse func(*bufio.Reader) (*Header, error), data []byte, max int) {
+	header, n, err := fuzzParser(parse, data)
+	if n > max {
+		t.Fatalf("consumed %d bytes, more than %d", n, max)
+	}
+	if err != nil {
+		return
+	}
+	if header == nil {
+		t.Fatal("nil header without error")
+	}
+
+	again, m, err := fuzzParser(parse, data[:n])
+	if err != nil {
+		t.Fatalf("%q parsed, but not its first %d bytes: %v", data, n, err)
+	}
+	if m != n || !sameHeader(header, again) {
+		t.Fatalf("%q: unstable parse: %+v != %+v", data, header, again)
+	}
+}
+
+func addConformanceSeeds(f *testing.F) {
+	for _, c := range loadConformanceCases(f) {
+		f.Add(c.input(f))
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	addConformanceSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		max := maxVersion2HeaderLength(data)
+		if bytes.HasPrefix(data, SIGV1) {
+			max = maxVersion1HeaderLength
+		}
+		fuzzHeader(t, Read, data, max)
+	})
+}
+
+func FuzzParseVersion1(f *testing.F) {
+	addConformanceSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzHeader(t, parseVersion1, data, maxVersion1HeaderLength)
+	})
+}
+
+func FuzzParseVersion2(f *testing.F) {
+	addConformanceSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parse := func(reader *bufio.Reader) (*Header, error) {
+			return parseVersion2(reader, nil)
+		}
+		fuzzHeader(t, parse, data, maxVersion2HeaderLength(data))
+	})
+}
@@ -0,0 +1,77 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// ConnInfo is the AuthInfo of gRPC peers accepted with Credentials.
+type ConnInfo struct {
+	credentials.CommonAuthInfo
+
+	// ID is the correlation ID of the connection.
+	ID string
+	// Header is the PROXY header of the connection, nil when there is none.
+	Header *Header
+	// AuthInfo is the one of the wrapped credentials.
+	AuthInfo credentials.AuthInfo
+}
+
+func (info ConnInfo) AuthType() string {
+	if info.AuthInfo != nil {
+		return info.AuthInfo.AuthType()
+	}
+	return "proxyproto"
+}
+
+// Credentials wraps the transport credentials of a gRPC server so that the
+// AuthInfo of its peers is a ConnInfo. The server must serve a Listener.
+func Credentials(inner credentials.TransportCredentials) credentials.TransportCredentials {
+	return &proxyCredentials{inner}
+}
+
+type proxyCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c *proxyCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxyConn, ok := ConnOf(rawConn)
+	if !ok {
+		return conn, authInfo, nil
+	}
+
+	info := ConnInfo{
+		ID:       proxyConn.ID(),
+		Header:   proxyConn.ProxyHeader(),
+		AuthInfo: authInfo,
+	}
+	if common, ok := authInfo.(interface {
+		GetCommonAuthInfo() credentials.CommonAuthInfo
+	}); ok {
+		info.CommonAuthInfo = common.GetCommonAuthInfo()
+	}
+	return conn, info, nil
+}
+
+func (c *proxyCredentials) Clone() credentials.TransportCredentials {
+	return &proxyCredentials{c.TransportCredentials.Clone()}
+}
+
+func grpcConnID(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(ConnInfo)
+	if !ok {
+		return "", false
+	}
+	return info.ID, true
+}
@@ -0,0 +1,85 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+)
+
+// HeaderFromAddrs returns a PROXY header of the given version describing a
+// connection from sourceAddr to destAddr. It falls back to a LOCAL header when
+// the addresses can't be represented.
+func HeaderFromAddrs(version byte, sourceAddr, destAddr net.Addr) *Header {
+	header := &Header{
+		Version:           version,
+		Command:           LOCAL,
+		TransportProtocol: UNSPEC,
+	}
+
+	switch sourceAddr := sourceAddr.(type) {
+	case *net.TCPAddr:
+		if destAddr, ok := destAddr.(*net.TCPAddr); ok {
+			header.TransportProtocol = TCPv6
+			if sourceAddr.IP.To4() != nil && destAddr.IP.To4() != nil {
+				header.TransportProtocol = TCPv4
+			}
+		}
+	case *net.UDPAddr:
+		if destAddr, ok := destAddr.(*net.UDPAddr); ok && version == 2 {
+			header.TransportProtocol = UDPv6
+			if sourceAddr.IP.To4() != nil && destAddr.IP.To4() != nil {
+				header.TransportProtocol = UDPv4
+			}
+		}
+	case *net.UnixAddr:
+		if _, ok := destAddr.(*net.UnixAddr); ok && version == 2 {
+			header.TransportProtocol = UnixStream
+			if sourceAddr.Net == "unixgram" {
+				header.TransportProtocol = UnixDatagram
+			}
+		}
+	}
+
+	if header.TransportProtocol != UNSPEC {
+		header.Command = PROXY
+		header.SourceAddr = sourceAddr
+		header.DestinationAddr = destAddr
+	}
+	return header
+}
+
+// Format returns the wire representation of the header.
+func (header *Header) Format() ([]byte, error) {
+	switch header.Version {
+	case 1:
+		return formatVersion1(header)
+	case 2:
+		return formatVersion2(header)
+	default:
+		return nil, ErrUnknownProxyProtocolVersion
+	}
+}
+
+// WriteTo writes the wire representation of the header to w.
+func (header *Header) WriteTo(w io.Writer) (int64, error) {
+	buf, err := header.Format()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// SetTLVs replaces the TLVs carried by a v2 header.
+func (header *Header) SetTLVs(tlvs []TLV) error {
+	raw, err := JoinTLVs(tlvs)
+	if err != nil {
+		return err
+	}
+	header.rawTLVs = raw
+	return nil
+}
+
+func validPort(port int) bool {
+	return port >= 0 && port <= 65535
+}
@@ -0,0 +1,106 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+)
+
+// maxUniqueIDLength is the largest PP2_TYPE_UNIQUE_ID value the spec allows.
+const maxUniqueIDLength = 128
+
+// NewUniqueID returns a random connection ID, 32 hex digits.
+func NewUniqueID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// UniqueIDTLV returns a PP2_TYPE_UNIQUE_ID TLV carrying a new connection ID, for
+// senders of headers.
+func UniqueIDTLV() TLV {
+	return TLV{Type: PP2_TYPE_UNIQUE_ID, Value: []byte(NewUniqueID())}
+}
+
+// ID returns the correlation ID of the connection: the PP2_TYPE_UNIQUE_ID TLV of
+// its header when there is one, hex encoded unless it is printable, and an ID
+// minted on first call otherwise.
+func (p *Conn) ID() string {
+	p.idOnce.Do(func() {
+		if value, ok := p.TLV(PP2_TYPE_UNIQUE_ID); ok && len(value) > 0 && len(value) <= maxUniqueIDLength {
+			p.id = formatUniqueID(value)
+			return
+		}
+		p.id = NewUniqueID()
+	})
+	return p.id
+}
+
+func formatUniqueID(value []byte) string {
+	for _, c := range value {
+		if c < 0x21 || c > 0x7e {
+			return hex.EncodeToString(value)
+		}
+	}
+	return string(value)
+}
+
+// ConnOf returns the PROXY connection conn was built on, looking through the
+// wrappers of this package, TLS, and those with an Unwrap() net.Conn method.
+func ConnOf(conn net.Conn) (*Conn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *Conn:
+			return c, true
+		case *skipConn:
+			return c.Conn, true
+		case *muxConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// connID returns the correlation ID of conn, or its remote address when it is
+// not a PROXY connection.
+func connID(conn net.Conn) string {
+	if proxyConn, ok := ConnOf(conn); ok {
+		return proxyConn.ID()
+	}
+	return conn.RemoteAddr().String()
+}
+
+type connKey struct{}
+
+// ConnContext is a http.Server ConnContext storing the PROXY connection in the
+// context of its requests, see ConnFromContext and ConnIDFromContext.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if proxyConn, ok := ConnOf(conn); ok {
+		return context.WithValue(ctx, connKey{}, proxyConn)
+	}
+	return ctx
+}
+
+// ConnFromContext returns the PROXY connection stored by ConnContext.
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	conn, ok := ctx.Value(connKey{}).(*Conn)
+	return conn, ok
+}
+
+// ConnIDFromContext returns the correlation ID of the connection stored by
+// ConnContext, or carried by the AuthInfo of a gRPC peer accepted with Credentials.
+func ConnIDFromContext(ctx context.Context) (string, bool) {
+	if conn, ok := ConnFromContext(ctx); ok {
+		return conn.ID(), true
+	}
+	return grpcConnID(ctx)
+}
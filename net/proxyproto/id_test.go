@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/gptlocal/wheels/grpc/stream"
+	"github.com/gptlocal/wheels/net/faultnet"
+)
+
+func TestConnID(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+
+	tests := []struct {
+		name   string
+		header []byte
+		id     string
+	}{
+		{"printable", testV2Header(src, dst, TLV{PP2_TYPE_UNIQUE_ID, []byte("req-42")}), "req-42"},
+		{"binary", testV2Header(src, dst, TLV{PP2_TYPE_UNIQUE_ID, []byte{0, 1, 0xff}}), "0001ff"},
+		{"missing", []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"), ""},
+	}
+
+	for _, tt := range tests {
+		client, server := faultnet.Pipe()
+		conn := NewConn(server)
+		client.Write(tt.header)
+
+		id := conn.ID()
+		if tt.id != "" && id != tt.id {
+			t.Fatalf("%s: bad: %q", tt.name, id)
+		}
+		if tt.id == "" && len(id) != 32 {
+			t.Fatalf("%s: bad minted ID: %q", tt.name, id)
+		}
+		if conn.ID() != id {
+			t.Fatalf("%s: ID changed", tt.name)
+		}
+		conn.Close()
+	}
+}
+
+func TestRelayUniqueID(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: backend}
+	defer pl.Close()
+	relay := startRelay(t, &Relay{Target: backend.Addr().String(), UniqueID: true})
+
+	client, err := net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	io.ReadFull(conn, make([]byte, 4))
+
+	value, ok := conn.(*Conn).TLV(PP2_TYPE_UNIQUE_ID)
+	if !ok || len(value) != 32 || conn.(*Conn).ID() != string(value) {
+		t.Fatalf("bad: %q", value)
+	}
+	if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+}
+
+func TestHTTPConnContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids := make(chan string, 1)
+	server := &http.Server{
+		ConnContext: ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := ConnIDFromContext(r.Context())
+			ids <- id
+		}),
+	}
+	go server.Serve(&Listener{Listener: l})
+	defer server.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(testV2Header(src, dst, TLV{PP2_TYPE_UNIQUE_ID, []byte("req-42")}))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+	select {
+	case id := <-ids:
+		if id != "req-42" {
+			t.Fatalf("bad: %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+type idServer struct {
+	stream.UnimplementedFibonacciServer
+	ids chan string
+}
+
+func (s *idServer) Calculate(req *stream.FibonacciRequest, srv stream.Fibonacci_CalculateServer) error {
+	id, _ := ConnIDFromContext(srv.Context())
+	s.ids <- id
+	return nil
+}
+
+func TestGRPCCredentials(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids := make(chan string, 1)
+	server := grpc.NewServer(grpc.Creds(Credentials(insecure.NewCredentials())))
+	stream.RegisterFibonacciServer(server, &idServer{ids: ids})
+	go server.Serve(&Listener{Listener: l})
+	defer server.Stop()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	cc, err := grpc.Dial(l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = conn.Write(testV2Header(src, dst, TLV{PP2_TYPE_UNIQUE_ID, []byte("req-42")}))
+			return conn, err
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	calc, err := stream.NewFibonacciClient(cc).Calculate(ctx, &stream.FibonacciRequest{Number: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	calc.Recv()
+
+	select {
+	case id := <-ids:
+		if id != "req-42" {
+			t.Fatalf("bad: %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+}
@@ -0,0 +1,311 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoHealthyBackend = errors.New("proxyproto: no healthy backend")
+)
+
+// Backend is a server a LoadBalancer forwards connections to.
+type Backend struct {
+	Addr string
+	// Version is the PROXY header version sent to the backend, 0 sends none.
+	Version byte
+
+	conns atomic.Int64
+	down  atomic.Bool
+}
+
+// Conns returns the number of connections currently forwarded to the backend.
+func (b *Backend) Conns() int64 {
+	return b.conns.Load()
+}
+
+// Healthy reports whether the backend passed its last health check. Backends
+// are healthy until a check fails.
+func (b *Backend) Healthy() bool {
+	return !b.down.Load()
+}
+
+// ParseBackend parses a backend in the form "[v1|v2|none@]host:port", backends
+// without a version get v2 headers.
+func ParseBackend(s string) (*Backend, error) {
+	backend := &Backend{Addr: s, Version: 2}
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		switch s[:i] {
+		case "v1":
+			backend.Version = 1
+		case "v2":
+			backend.Version = 2
+		case "none":
+			backend.Version = 0
+		default:
+			return nil, fmt.Errorf("backend %q: unknown header version %q", s, s[:i])
+		}
+		backend.Addr = s[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(backend.Addr); err != nil {
+		return nil, fmt.Errorf("backend %q: %w", s, err)
+	}
+	return backend, nil
+}
+
+// Balance selects the backend of each new connection.
+type Balance int
+
+const (
+	// RoundRobin takes the healthy backends in turn.
+	RoundRobin Balance = iota
+	// LeastConns takes the healthy backend with the fewest connections, the
+	// first one on ties.
+	LeastConns
+)
+
+// LoadBalancer forwards TCP connections to a set of backends, sending each one a
+// PROXY header describing the client. When it serves a Listener, the client is
+// the one of the incoming header.
+type LoadBalancer struct {
+	Backends []*Backend
+	Balance  Balance
+
+	// DialTimeout bounds connecting to a backend, zero means no limit. A backend
+	// that can't be reached is skipped for the next one.
+	DialTimeout time.Duration
+
+	// HealthInterval is the time between two active health checks of a backend,
+	// zero disables them. A check connects to the backend, sends a LOCAL header
+	// when it expects one, and fails when that takes more than HealthTimeout
+	// (DialTimeout, or one second, if unset).
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	next atomic.Uint64
+}
+
+// Serve forwards every connection accepted from l until it fails, and runs the
+// health checks meanwhile.
+func (lb *LoadBalancer) Serve(l net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if lb.HealthInterval > 0 {
+		go lb.CheckHealth(ctx)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := lb.ServeConn(conn); err != nil {
+				log.Printf("lb %s %s: %v", connID(conn), conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn forwards a single connection and closes it when either side is done.
+func (lb *LoadBalancer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := headerError(conn); err != nil {
+		return err
+	}
+
+	backend, upstream, err := lb.dial()
+	if err != nil {
+		return err
+	}
+	defer backend.conns.Add(-1)
+	defer upstream.Close()
+
+	if backend.Version != 0 {
+		header, err := backendHeader(backend.Version, conn)
+		if err != nil {
+			return err
+		}
+		if _, err := upstream.Write(header); err != nil {
+			return err
+		}
+	}
+	return pipe(conn, upstream)
+}
+
+// headerError returns the error reading the PROXY header of conn, nil when it
+// has none or isn't a PROXY connection.
+func headerError(conn net.Conn) error {
+	proxyConn, ok := ConnOf(conn)
+	if !ok {
+		return nil
+	}
+	proxyConn.once.Do(func() { proxyConn.readErr = proxyConn.readHeader() })
+	if proxyConn.readErr != ErrNoProxyProtocol {
+		return proxyConn.readErr
+	}
+	return nil
+}
+
+// backendHeader formats the header sent ahead of conn, a LOCAL one when conn
+// arrived with a LOCAL header. v2 ones carry the TLVs conn arrived with, those
+// of the types in tlvs replaced by them, and a PP2_TYPE_UNIQUE_ID, minted when
+// there is none.
+func backendHeader(version byte, conn net.Conn, tlvs ...TLV) ([]byte, error) {
+	var received *Header
+	proxyConn, ok := ConnOf(conn)
+	if ok {
+		received = proxyConn.ProxyHeader()
+	}
+
+	header := HeaderFromAddrs(version, conn.RemoteAddr(), conn.LocalAddr())
+	if received != nil && received.Command.IsLocal() {
+		header = &Header{Version: version, Command: LOCAL, TransportProtocol: UNSPEC}
+	}
+	if version != 2 {
+		return header.Format()
+	}
+
+	var forwarded []TLV
+	if received != nil {
+		receivedTLVs, err := received.TLVs()
+		if err != nil {
+			return nil, err
+		}
+		for _, tlv := range receivedTLVs {
+			if !hasTLVType(tlvs, tlv.Type) {
+				forwarded = append(forwarded, tlv)
+			}
+		}
+	}
+	forwarded = append(forwarded, tlvs...)
+	if !hasTLVType(forwarded, PP2_TYPE_UNIQUE_ID) {
+		id := NewUniqueID()
+		if ok {
+			id = proxyConn.ID()
+		}
+		forwarded = append(forwarded, TLV{Type: PP2_TYPE_UNIQUE_ID, Value: []byte(id)})
+	}
+	if err := header.SetTLVs(forwarded); err != nil {
+		return nil, err
+	}
+	return header.Format()
+}
+
+func hasTLVType(tlvs []TLV, t PP2Type) bool {
+	for _, tlv := range tlvs {
+		if tlv.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to the backend picked for a new connection, trying the next
+// ones when it fails.
+func (lb *LoadBalancer) dial() (*Backend, net.Conn, error) {
+	var errs []error
+	tried := make(map[*Backend]bool)
+	for len(tried) < len(lb.Backends) {
+		backend := lb.pick(tried)
+		if backend == nil {
+			break
+		}
+		tried[backend] = true
+
+		backend.conns.Add(1)
+		conn, err := net.DialTimeout("tcp", backend.Addr, lb.DialTimeout)
+		if err == nil {
+			return backend, conn, nil
+		}
+		backend.conns.Add(-1)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, nil, ErrNoHealthyBackend
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// pick returns the healthy backend selected by the balance among those not tried
+// yet, nil when there is none.
+func (lb *LoadBalancer) pick(tried map[*Backend]bool) *Backend {
+	var candidates []*Backend
+	for _, backend := range lb.Backends {
+		if backend.Healthy() && !tried[backend] {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if lb.Balance == LeastConns {
+		best := candidates[0]
+		for _, backend := range candidates[1:] {
+			if backend.Conns() < best.Conns() {
+				best = backend
+			}
+		}
+		return best
+	}
+	return candidates[(lb.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// CheckHealth checks every backend each HealthInterval until ctx is done.
+func (lb *LoadBalancer) CheckHealth(ctx context.Context) {
+	ticker := time.NewTicker(lb.HealthInterval)
+	defer ticker.Stop()
+	for {
+		for _, backend := range lb.Backends {
+			go lb.checkBackend(backend)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (lb *LoadBalancer) checkBackend(backend *Backend) {
+	err := lb.probe(backend)
+	if down := err != nil; backend.down.Swap(down) != down {
+		if down {
+			log.Printf("lb: backend %s is down: %v", backend.Addr, err)
+		} else {
+			log.Printf("lb: backend %s is up", backend.Addr)
+		}
+	}
+}
+
+func (lb *LoadBalancer) probe(backend *Backend) error {
+	timeout := lb.HealthTimeout
+	if timeout <= 0 {
+		timeout = lb.DialTimeout
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", backend.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if backend.Version == 0 {
+		return nil
+	}
+
+	header := &Header{Version: backend.Version, Command: LOCAL, TransportProtocol: UNSPEC}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = header.WriteTo(conn)
+	return err
+}
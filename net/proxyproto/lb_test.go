@@ -0,0 +1,197 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startBackend returns a backend listening on a new PROXY listener.
+func startBackend(t *testing.T, version byte) (*Backend, *Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	t.Cleanup(func() { pl.Close() })
+	return &Backend{Addr: l.Addr().String(), Version: version}, pl
+}
+
+func startLB(t *testing.T, lb *LoadBalancer) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	go lb.Serve(pl)
+	t.Cleanup(func() { pl.Close() })
+	return pl
+}
+
+// acceptPing accepts a connection from l and checks it starts with "ping".
+func acceptPing(t *testing.T, l net.Listener) *Conn {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil || string(recv) != "ping" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+	return conn.(*Conn)
+}
+
+func dialPing(t *testing.T, addr, header string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte(header + "ping"))
+	return conn
+}
+
+func TestLoadBalancerRoundRobin(t *testing.T) {
+	b1, l1 := startBackend(t, 1)
+	b2, l2 := startBackend(t, 2)
+	lb := startLB(t, &LoadBalancer{Backends: []*Backend{b1, b2}})
+
+	for i, l := range []net.Listener{l1, l2, l1} {
+		dialPing(t, lb.Addr().String(), "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+		conn := acceptPing(t, l)
+		if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+			t.Fatalf("%d: bad: %v", i, conn.RemoteAddr())
+		}
+		if version := conn.ProxyHeader().Version; version != []byte{1, 2, 1}[i] {
+			t.Fatalf("%d: bad version: %d", i, version)
+		}
+	}
+}
+
+func TestLoadBalancerForwardsTLVs(t *testing.T) {
+	b, l := startBackend(t, 2)
+	lb := startLB(t, &LoadBalancer{Backends: []*Backend{b}})
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+
+	dialPing(t, lb.Addr().String(), string(testV2Header(src, dst,
+		TLV{PP2_TYPE_AUTHORITY, []byte("example.com")},
+		TLV{PP2_TYPE_UNIQUE_ID, []byte("upstream-id")})))
+	conn := acceptPing(t, l)
+	if authority, _ := conn.TLV(PP2_TYPE_AUTHORITY); string(authority) != "example.com" {
+		t.Fatalf("bad authority: %q", authority)
+	}
+	if conn.ID() != "upstream-id" {
+		t.Fatalf("bad id: %q", conn.ID())
+	}
+
+	// Connections without one get a new ID.
+	dialPing(t, lb.Addr().String(), "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+	conn = acceptPing(t, l)
+	if id, ok := conn.TLV(PP2_TYPE_UNIQUE_ID); !ok || len(id) == 0 {
+		t.Fatalf("no unique id forwarded")
+	}
+}
+
+func TestLoadBalancerForwardsLocal(t *testing.T) {
+	b, l := startBackend(t, 2)
+	lb := startLB(t, &LoadBalancer{Backends: []*Backend{b}})
+
+	dialPing(t, lb.Addr().String(), "PROXY UNKNOWN\r\n")
+	conn := acceptPing(t, l)
+	if header := conn.ProxyHeader(); header == nil || !header.Command.IsLocal() {
+		t.Fatalf("expected a LOCAL header, got: %+v", header)
+	}
+}
+
+func TestLoadBalancerDropsBadHeader(t *testing.T) {
+	b, l := startBackend(t, 2)
+	lb := startLB(t, &LoadBalancer{Backends: []*Backend{b}})
+
+	client := dialPing(t, lb.Addr().String(), "PROXY TCP4 10.1.1.1 20.2.2.2 1000\r\n")
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got: %v", err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Fatal("connection with a bad header forwarded")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLoadBalancerLeastConns(t *testing.T) {
+	b1, l1 := startBackend(t, 2)
+	b2, l2 := startBackend(t, 0)
+	lb := startLB(t, &LoadBalancer{Backends: []*Backend{b1, b2}, Balance: LeastConns})
+
+	dialPing(t, lb.Addr().String(), "")
+	acceptPing(t, l1)
+	// b1 still holds a connection.
+	dialPing(t, lb.Addr().String(), "")
+	conn := acceptPing(t, l2)
+	if conn.ProxyHeader() != nil {
+		t.Fatalf("unexpected header: %+v", conn.ProxyHeader())
+	}
+	if b1.Conns() != 1 || b2.Conns() != 1 {
+		t.Fatalf("bad: %d %d", b1.Conns(), b2.Conns())
+	}
+}
+
+func TestLoadBalancerHealthCheck(t *testing.T) {
+	b1, l1 := startBackend(t, 2)
+	b2, l2 := startBackend(t, 2)
+	l2.Close()
+	lb := &LoadBalancer{Backends: []*Backend{b1, b2}, HealthInterval: 10 * time.Millisecond}
+	lbl := startLB(t, lb)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b2.Healthy() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b2.Healthy() || !b1.Healthy() {
+		t.Fatalf("bad health: %v %v", b1.Healthy(), b2.Healthy())
+	}
+
+	// The health probe of b1 is a LOCAL header, kept out of Accept.
+	l1.HealthCheck = IgnoreHealthCheck
+	for i := 0; i < 2; i++ {
+		dialPing(t, lbl.Addr().String(), "")
+		acceptPing(t, l1)
+	}
+}
+
+func TestLoadBalancerFailover(t *testing.T) {
+	b1, l1 := startBackend(t, 2)
+	b2, l2 := startBackend(t, 2)
+	l2.Close()
+	lb := startLB(t, &LoadBalancer{Backends: []*Backend{b2, b1}})
+
+	dialPing(t, lb.Addr().String(), "")
+	acceptPing(t, l1)
+}
+
+func TestParseBackend(t *testing.T) {
+	for s, version := range map[string]byte{"127.0.0.1:80": 2, "v1@127.0.0.1:80": 1, "none@[::1]:80": 0} {
+		backend, err := ParseBackend(s)
+		if err != nil || backend.Version != version || !strings.HasSuffix(s, backend.Addr) {
+			t.Fatalf("%s: bad: %+v %v", s, backend, err)
+		}
+	}
+	for _, s := range []string{"v3@127.0.0.1:80", "127.0.0.1"} {
+		if _, err := ParseBackend(s); err == nil {
+			t.Fatalf("%s: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrPayloadTooLarge = errors.New("proxyproto: version 2 payload exceeds the configured limit")
+	ErrTooManyTLVs     = errors.New("proxyproto: version 2 header carries too many TLVs")
+	ErrTLVTooLarge     = errors.New("proxyproto: TLV exceeds the configured size limit")
+)
+
+// HeaderLimits bounds the resources a single header may use. Zero fields mean no
+// limit beyond the protocol's own.
+type HeaderLimits struct {
+	// MaxV2Payload bounds the declared length of a v2 header, checked before any of it is buffered.
+	MaxV2Payload int
+	// MaxTLVs bounds the number of TLVs of a v2 header.
+	MaxTLVs int
+	// MaxTLVSize bounds the length of a single TLV value.
+	MaxTLVSize int
+}
+
+func (limits *HeaderLimits) checkPayload(length uint16) error {
+	if limits != nil && limits.MaxV2Payload > 0 && int(length) > limits.MaxV2Payload {
+		return ErrPayloadTooLarge
+	}
+	return nil
+}
+
+func (limits *HeaderLimits) checkTLVs(raw []byte) error {
+	if limits == nil || (limits.MaxTLVs <= 0 && limits.MaxTLVSize <= 0) {
+		return nil
+	}
+	tlvs, err := SplitTLVs(raw)
+	if err != nil {
+		return err
+	}
+	if limits.MaxTLVs > 0 && len(tlvs) > limits.MaxTLVs {
+		return ErrTooManyTLVs
+	}
+	if limits.MaxTLVSize > 0 {
+		for _, tlv := range tlvs {
+			if len(tlv.Value) > limits.MaxTLVSize {
+				return ErrTLVTooLarge
+			}
+		}
+	}
+	return nil
+}
+
+// Metrics counts connections a Listener turned away.
+type Metrics struct {
+	PayloadTooLarge       atomic.Uint64
+	TooManyTLVs           atomic.Uint64
+	TLVTooLarge           atomic.Uint64
+	TooManyPendingPerIP   atomic.Uint64
+	PendingShed           atomic.Uint64
+	HeaderErrors          atomic.Uint64
+	ACLDenied             atomic.Uint64
+	RateLimited           atomic.Uint64
+	TooManyConnsPerClient atomic.Uint64
+}
+
+func (m *Metrics) countHeaderError(err error) {
+	if m == nil || err == nil || err == ErrNoProxyProtocol {
+		return
+	}
+	switch err {
+	case ErrPayloadTooLarge:
+		m.PayloadTooLarge.Add(1)
+	case ErrTooManyTLVs:
+		m.TooManyTLVs.Add(1)
+	case ErrTLVTooLarge:
+		m.TLVTooLarge.Add(1)
+	default:
+		m.HeaderErrors.Add(1)
+	}
+}
+
+// pendingTracker counts the connections of each peer whose header hasn't been read yet.
+type pendingTracker struct {
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// acquire reserves a pending slot for the peer of conn, the returned release
+// function may be called more than once.
+func (t *pendingTracker) acquire(conn net.Conn, max int) (func(), bool) {
+	key := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[string]int)
+	}
+	if t.pending[key] >= max {
+		return nil, false
+	}
+	t.pending[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.pending[key]--; t.pending[key] <= 0 {
+				delete(t.pending, key)
+			}
+		})
+	}, true
+}
@@ -0,0 +1,76 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadLimited(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	limits := &HeaderLimits{MaxV2Payload: 64, MaxTLVs: 2, MaxTLVSize: 8}
+
+	tests := []struct {
+		name string
+		tlvs []TLV
+		err  error
+	}{
+		{"within limits", []TLV{{PP2_TYPE_AUTHORITY, []byte("a.com")}}, nil},
+		{"payload too large", []TLV{{PP2_TYPE_NOOP, make([]byte, 64)}}, ErrPayloadTooLarge},
+		{"too many tlvs", []TLV{{PP2_TYPE_NOOP, nil}, {PP2_TYPE_NOOP, nil}, {PP2_TYPE_NOOP, nil}}, ErrTooManyTLVs},
+		{"tlv too large", []TLV{{PP2_TYPE_AUTHORITY, []byte("example.com")}}, ErrTLVTooLarge},
+	}
+
+	metrics := &Metrics{}
+	for _, tt := range tests {
+		reader := bufio.NewReader(bytes.NewReader(testV2Header(src, dst, tt.tlvs...)))
+		_, err := ReadLimited(reader, limits)
+		if err != tt.err {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+		metrics.countHeaderError(err)
+	}
+	if metrics.PayloadTooLarge.Load() != 1 || metrics.TooManyTLVs.Load() != 1 || metrics.TLVTooLarge.Load() != 1 {
+		t.Fatalf("bad metrics: %d %d %d", metrics.PayloadTooLarge.Load(), metrics.TooManyTLVs.Load(), metrics.TLVTooLarge.Load())
+	}
+}
+
+func TestListenerMaxPendingPerIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	metrics := &Metrics{}
+	pl := &Listener{Listener: l, MaxPendingPerIP: 1, Metrics: metrics}
+	defer pl.Close()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer first.Close()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// A rejected connection never comes out of Accept, watch it from the client side.
+	go pl.Accept()
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected second connection to be closed")
+	}
+	if metrics.TooManyPendingPerIP.Load() != 1 {
+		t.Fatalf("bad: %d", metrics.TooManyPendingPerIP.Load())
+	}
+}
@@ -0,0 +1,159 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener wraps a net.Listener so that accepted connections have their PROXY
+// header parsed on first use.
+type Listener struct {
+	Listener net.Listener
+
+	// ReadHeaderTimeout bounds how long reading the header may take, zero means no limit.
+	ReadHeaderTimeout time.Duration
+
+	// HealthCheck, when set, keeps LOCAL (v2) and UNKNOWN (v1) connections, which load
+	// balancers send as health probes, out of Accept. Headers are then read by the
+	// header workers, DefaultHeaderWorkers of them if HeaderWorkers is unset.
+	// It runs in a header worker, with the connection's deadline set ReadHeaderTimeout
+	// ahead, and the connection is closed once it returns. Use IgnoreHealthCheck to
+	// close them straight away.
+	HealthCheck func(conn *Conn)
+
+	// HeaderWorkers, when positive, reads headers in that many goroutines right after
+	// accept, and Accept only returns connections whose header has been parsed.
+	// HealthCheck, ACL and Limiter need the header before Accept and turn them on.
+	// Connections whose header fails or doesn't arrive within ReadHeaderTimeout
+	// (DefaultReadHeaderTimeout if unset) are dropped.
+	HeaderWorkers int
+	// MaxPendingHeaders bounds the connections waiting for a header worker, newer
+	// ones are closed. Defaults to HeaderWorkers.
+	MaxPendingHeaders int
+
+	// Limits bounds the size of the headers read from accepted connections.
+	Limits HeaderLimits
+	// MaxPendingPerIP bounds the connections from a single peer address whose header
+	// hasn't been read yet, newer ones are closed. Zero means no limit.
+	MaxPendingPerIP int
+	// Metrics, when set, counts the connections turned away by the limits.
+	Metrics *Metrics
+
+	// Normalize rewrites the addresses of parsed headers into one canonical form.
+	Normalize AddrNormalization
+
+	// ACL, when set, closes connections whose source it denies, after health checks
+	// are taken out. Headers are then read by the header workers.
+	ACL *ACL
+	// Limiter, when set, closes or delays connections of clients over its limits,
+	// after the ACL is checked. Headers are then read by the header workers.
+	Limiter *ClientLimiter
+
+	// AccessLog, when set, records every connection once it closes, including those
+	// turned away after their header was read. Health checks aren't recorded.
+	AccessLog *AccessLog
+
+	poolOnce sync.Once
+	pool     *headerPool
+	pending  pendingTracker
+
+	ctxOnce sync.Once
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// IgnoreHealthCheck is a HealthCheck closing health probes without answering them.
+func IgnoreHealthCheck(*Conn) {}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.poolOnce.Do(l.startPool)
+	if l.pool != nil {
+		return l.pool.Accept()
+	}
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Without header workers nothing needs the header before Accept, it is
+		// read on first use.
+		newConn, ok := l.newConn(conn)
+		if !ok {
+			continue
+		}
+		return newConn, nil
+	}
+}
+
+// newConn wraps an accepted connection with the listener's settings, it closes
+// the connection and returns false when its peer has too many pending headers.
+func (l *Listener) newConn(conn net.Conn) (*Conn, bool) {
+	newConn := NewConn(conn)
+	newConn.readHeaderTimeout = l.ReadHeaderTimeout
+	newConn.limits = &l.Limits
+	newConn.metrics = l.Metrics
+	newConn.normalize = &l.Normalize
+	newConn.ctx = l.context()
+	if l.AccessLog != nil {
+		newConn.access = newConnAccess(l.AccessLog)
+	}
+
+	if l.MaxPendingPerIP > 0 {
+		release, ok := l.pending.acquire(conn, l.MaxPendingPerIP)
+		if !ok {
+			if l.Metrics != nil {
+				l.Metrics.TooManyPendingPerIP.Add(1)
+			}
+			conn.Close()
+			return nil, false
+		}
+		newConn.release = release
+	}
+	return newConn, true
+}
+
+// admit checks the source of conn against the ACL and the Limiter, it closes the
+// connection and returns false when it is turned away.
+func (l *Listener) admit(conn *Conn) bool {
+	if l.ACL == nil || l.ACL.allowConn(conn) {
+		return l.limit(conn)
+	}
+	if l.Metrics != nil {
+		l.Metrics.ACLDenied.Add(1)
+	}
+	conn.access.fail(ErrACLDenied)
+	conn.Close()
+	return false
+}
+
+func (l *Listener) answerHealthCheck(conn *Conn) {
+	conn.access = nil
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(conn.readHeaderTimeout))
+	l.HealthCheck(conn)
+}
+
+// context returns a context canceled when the listener closes, so that pending
+// header reads don't hold up shutdown.
+func (l *Listener) context() context.Context {
+	l.ctxOnce.Do(func() { l.ctx, l.cancel = context.WithCancel(context.Background()) })
+	return l.ctx
+}
+
+func (l *Listener) Close() error {
+	l.context()
+	l.cancel()
+	l.poolOnce.Do(func() {})
+	if l.pool != nil {
+		l.pool.close()
+	}
+	return l.Listener.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.Listener.Addr()
+}
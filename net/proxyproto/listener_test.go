@@ -0,0 +1,236 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	probes := make(chan *Header, 2)
+	pl := &Listener{
+		Listener:          l,
+		ReadHeaderTimeout: time.Second,
+		HealthCheck: func(conn *Conn) {
+			probes <- conn.header
+			conn.Write([]byte("OK"))
+		},
+	}
+	defer pl.Close()
+
+	localV2 := append(append([]byte{}, SIGV2...), byte(LOCAL), byte(UNSPEC), '\x00', '\x00')
+	payloads := [][]byte{
+		localV2,
+		[]byte("PROXY UNKNOWN\r\n"),
+		[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nping"),
+	}
+	for _, payload := range payloads {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+	recv := make([]byte, 4)
+	if _, err := io.ReadFull(conn, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %v", recv)
+	}
+
+	for i := 0; i < 2; i++ {
+		header := <-probes
+		if !header.Command.IsLocal() {
+			t.Fatalf("bad: %v", header.Command)
+		}
+	}
+}
+
+func TestListenerHealthCheckDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	answered := make(chan error, 1)
+	pl := &Listener{
+		Listener:          l,
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		HeaderWorkers:     1,
+		MaxPendingHeaders: 2,
+		// A probe which never closes would hold the only worker without a deadline.
+		HealthCheck: func(conn *Conn) {
+			_, err := io.ReadAll(conn)
+			answered <- err
+		},
+	}
+	defer pl.Close()
+
+	for _, payload := range []string{"PROXY UNKNOWN\r\n", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+	var ne net.Error
+	if err := <-answered; !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+}
+
+func TestListenerHeaderWorkers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pl := &Listener{
+		Listener:          l,
+		ReadHeaderTimeout: 200 * time.Millisecond,
+		HeaderWorkers:     2,
+		MaxPendingHeaders: 4,
+	}
+	defer pl.Close()
+
+	// A client that never sends its header must not hold back the next one.
+	slow, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("PROXY TCP4"))
+
+	fast, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer fast.Close()
+	fast.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+
+	// The slow client is dropped once its header times out.
+	slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected slow connection to be closed, got: %v", err)
+	}
+}
+
+func TestListenerKeepsReadDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l, ReadHeaderTimeout: 5 * time.Second}
+	defer pl.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+	errc := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("expected a timeout, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read deadline lost while reading the header")
+	}
+}
+
+func TestListenerSilentClientDoesntBlockAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// No HeaderWorkers and no ReadHeaderTimeout, but the health check needs the
+	// header before Accept.
+	pl := &Listener{Listener: l, HealthCheck: IgnoreHealthCheck}
+	defer pl.Close()
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := pl.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != "10.1.1.1:1000" {
+			t.Fatalf("bad remote address: %v", conn.RemoteAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent client blocked Accept")
+	}
+}
@@ -0,0 +1,313 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderKind is a kind of header sent by the LoadGenerator.
+type HeaderKind int
+
+const (
+	KindV1 HeaderKind = iota
+	KindV2
+	KindLocal
+	KindMalformed
+)
+
+var headerKindNames = []string{"v1", "v2", "local", "malformed"}
+
+func (k HeaderKind) String() string {
+	if k < 0 || int(k) >= len(headerKindNames) {
+		return fmt.Sprintf("HeaderKind(%d)", k)
+	}
+	return headerKindNames[k]
+}
+
+// HeaderMix weighs the kinds of headers sent, see ParseHeaderMix.
+type HeaderMix map[HeaderKind]int
+
+// ParseHeaderMix parses a mix such as "v1=1,v2=3,local=1,malformed=1".
+func ParseHeaderMix(s string) (HeaderMix, error) {
+	mix := HeaderMix{}
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			weight = "1"
+		}
+		kind := -1
+		for i, kindName := range headerKindNames {
+			if name == kindName {
+				kind = i
+			}
+		}
+		w, err := strconv.Atoi(weight)
+		if kind < 0 || err != nil || w < 0 {
+			return nil, fmt.Errorf("header mix %q: bad entry %q", s, part)
+		}
+		mix[HeaderKind(kind)] += w
+	}
+	if mix.total() == 0 {
+		return nil, fmt.Errorf("header mix %q: no positive weight", s)
+	}
+	return mix, nil
+}
+
+// total returns the sum of the weights of the known kinds.
+func (mix HeaderMix) total() int {
+	total := 0
+	for kind := KindV1; kind <= KindMalformed; kind++ {
+		total += mix[kind]
+	}
+	return total
+}
+
+// pick returns a kind drawn according to the weights, mix must have a positive
+// total.
+func (mix HeaderMix) pick(rnd *rand.Rand) HeaderKind {
+	n := rnd.Intn(mix.total())
+	kind := KindV1
+	for n >= mix[kind] {
+		n -= mix[kind]
+		kind++
+	}
+	return kind
+}
+
+// malformedHeaders are sent for KindMalformed, in turn.
+var malformedHeaders = [][]byte{
+	[]byte("PROXY TCP4 10.1.1 20.2.2.2 1000 2000\r\n"),
+	[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 99999\r\n"),
+	[]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\n"),
+	append(append([]byte{}, SIGV2...), 0x31, 0x11, 0x00, 0x0c),
+	append(append([]byte{}, SIGV2...), 0x21, 0x11, 0x00, 0x04, 10, 1, 1, 1),
+}
+
+// newHeader returns the header bytes of one connection of the given kind.
+func newHeader(kind HeaderKind, rnd *rand.Rand, dst *net.TCPAddr) []byte {
+	src := &net.TCPAddr{
+		IP:   net.IPv4(10, byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(1+rnd.Intn(254))),
+		Port: 1024 + rnd.Intn(64511),
+	}
+	if dst == nil || dst.IP.To4() == nil {
+		dst = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	}
+
+	var header *Header
+	switch kind {
+	case KindV1:
+		header = HeaderFromAddrs(1, src, dst)
+	case KindV2:
+		header = HeaderFromAddrs(2, src, dst)
+	case KindLocal:
+		header = &Header{Version: 2, Command: LOCAL, TransportProtocol: UNSPEC}
+	default:
+		return malformedHeaders[rnd.Intn(len(malformedHeaders))]
+	}
+	raw, _ := header.Format()
+	return raw
+}
+
+// LoadGenerator opens connections to a PROXY-aware server, each one sending a
+// header followed by Payload, to measure how many it sustains.
+type LoadGenerator struct {
+	Target string
+	// Concurrency is the number of connections open at once, defaults to 1.
+	Concurrency int
+	// Duration bounds the run, Connections the number of connections made. The
+	// run stops at whichever comes first, at least one must be set.
+	Duration    time.Duration
+	Connections int
+	Mix         HeaderMix
+	Payload     []byte
+	// WaitReply waits for the first byte of the server's reply before closing a
+	// connection, latency is then measured up to it. Otherwise it is measured up
+	// to the end of the write.
+	WaitReply bool
+	// Timeout bounds each connection, defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// LoadReport is the outcome of a LoadGenerator run.
+type LoadReport struct {
+	Elapsed     time.Duration
+	Connections int
+	// Errors counts failed connections by header kind and error class.
+	Errors map[string]int
+	// Latencies of the successful connections, sorted.
+	Latencies []time.Duration
+}
+
+// Rate returns the connections made per second.
+func (r *LoadReport) Rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Connections) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which p percent of the successful
+// connections fall.
+func (r *LoadReport) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(r.Latencies)-1))
+	return r.Latencies[i]
+}
+
+// WriteTo writes a human readable summary of the report.
+func (r *LoadReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	failed := 0
+	for _, n := range r.Errors {
+		failed += n
+	}
+	fmt.Fprintf(&b, "connections: %d in %v (%.1f/s), %d ok, %d failed\n",
+		r.Connections, r.Elapsed.Round(time.Millisecond), r.Rate(), len(r.Latencies), failed)
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(&b, "latency: p50 %v, p90 %v, p99 %v, max %v\n",
+			r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Latencies[len(r.Latencies)-1])
+	}
+	keys := make([]string, 0, len(r.Errors))
+	for key := range r.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "errors %s: %d\n", key, r.Errors[key])
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Run opens connections until the run is over or ctx is done.
+func (g *LoadGenerator) Run(ctx context.Context) (*LoadReport, error) {
+	if g.Duration <= 0 && g.Connections <= 0 {
+		return nil, errors.New("loadgen: either Duration or Connections must be set")
+	}
+	if g.Mix.total() <= 0 {
+		return nil, errors.New("loadgen: Mix must have a positive weight")
+	}
+	if g.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Duration)
+		defer cancel()
+	}
+	concurrency := g.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	dst, _ := net.ResolveTCPAddr("tcp", g.Target)
+
+	var (
+		started atomic.Int64
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		report  = &LoadReport{Errors: make(map[string]int)}
+	)
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				if g.Connections > 0 && started.Add(1) > int64(g.Connections) {
+					return
+				}
+				kind := g.Mix.pick(rnd)
+				latency, err := g.connect(ctx, newHeader(kind, rnd, dst))
+				if err != nil && ctx.Err() != nil {
+					// Cut short by the end of the run.
+					return
+				}
+
+				mu.Lock()
+				report.Connections++
+				if err != nil {
+					report.Errors[kind.String()+"/"+errorClass(err)]++
+				} else {
+					report.Latencies = append(report.Latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	report.Elapsed = time.Since(start)
+	sort.Slice(report.Latencies, func(i, j int) bool { return report.Latencies[i] < report.Latencies[j] })
+	return report, nil
+}
+
+// errClosedBeforeReply is returned when the server closes without replying.
+var errClosedBeforeReply = errors.New("closed before reply")
+
+// connect makes one connection and returns its latency.
+func (g *LoadGenerator) connect(ctx context.Context, header []byte) (time.Duration, error) {
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	start := time.Now()
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", g.Target)
+	if err != nil {
+		return 0, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	deadline := start.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// header may be shared, don't append to it.
+	msg := make([]byte, 0, len(header)+len(g.Payload))
+	msg = append(append(msg, header...), g.Payload...)
+	if _, err := conn.Write(msg); err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+	if !g.WaitReply {
+		return time.Since(start), nil
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if err == io.EOF {
+			err = errClosedBeforeReply
+		}
+		return 0, fmt.Errorf("read: %w", err)
+	}
+	return time.Since(start), nil
+}
+
+// errorClass names the kind of a connection error for the report.
+func errorClass(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, errClosedBeforeReply):
+		return "closed"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	phase, _, _ := strings.Cut(err.Error(), ":")
+	switch {
+	case strings.Contains(err.Error(), "connection reset"):
+		return phase + " reset"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "refused"
+	}
+	return phase + " error"
+}
@@ -0,0 +1,87 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHeaderMix(t *testing.T) {
+	mix, err := ParseHeaderMix("v1=1, v2=3,malformed")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mix[KindV1] != 1 || mix[KindV2] != 3 || mix[KindMalformed] != 1 || mix[KindLocal] != 0 {
+		t.Fatalf("bad: %v", mix)
+	}
+	for _, s := range []string{"v3=1", "v1=x", "v1=-1", "v1=0", "v1=0,local=0"} {
+		if _, err := ParseHeaderMix(s); err == nil {
+			t.Fatalf("%s: expected an error", s)
+		}
+	}
+	if s := HeaderKind(7).String(); s != "HeaderKind(7)" {
+		t.Fatalf("bad: %s", s)
+	}
+}
+
+func TestLoadGenerator(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l, HeaderWorkers: 4, HealthCheck: func(conn *Conn) { conn.Write([]byte("ok")) }}
+	defer pl.Close()
+	go func() {
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if _, err := conn.Read(buf); err == nil {
+					conn.Write(buf)
+				}
+			}()
+		}
+	}()
+
+	g := &LoadGenerator{
+		Target:      l.Addr().String(),
+		Concurrency: 8,
+		Connections: 200,
+		Mix:         HeaderMix{KindV1: 1, KindV2: 1, KindLocal: 1, KindMalformed: 1},
+		Payload:     []byte("ping"),
+		WaitReply:   true,
+		Timeout:     5 * time.Second,
+	}
+	report, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Connections != 200 {
+		t.Fatalf("bad: %d", report.Connections)
+	}
+	// Malformed headers are dropped, and only those.
+	for key := range report.Errors {
+		if key != "malformed/closed" && key != "malformed/read reset" {
+			t.Fatalf("unexpected errors: %v", report.Errors)
+		}
+	}
+	if report.Errors["malformed/closed"]+report.Errors["malformed/read reset"]+len(report.Latencies) != 200 {
+		t.Fatalf("bad: %v, %d ok", report.Errors, len(report.Latencies))
+	}
+	if report.Percentile(50) > report.Percentile(99) || report.Rate() <= 0 {
+		t.Fatalf("bad: %v %v %v", report.Percentile(50), report.Percentile(99), report.Rate())
+	}
+
+	var out bytes.Buffer
+	report.WriteTo(&out)
+	if !strings.Contains(out.String(), "connections: 200") || !strings.Contains(out.String(), "latency: p50") {
+		t.Fatalf("bad: %s", out.String())
+	}
+}
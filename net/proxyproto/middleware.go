@@ -0,0 +1,474 @@
+package proxyproto
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ListenerMiddleware decorates a listener, and through its Accept the
+// connections it returns.
+type ListenerMiddleware func(net.Listener) net.Listener
+
+// Chain wraps l with middlewares in the declared order: the first one is the
+// closest to the socket, the last one is what the service accepts from.
+func Chain(l net.Listener, middlewares ...ListenerMiddleware) net.Listener {
+	for _, middleware := range middlewares {
+		l = middleware(l)
+	}
+	return l
+}
+
+// WrapConn returns a middleware applying wrap to every accepted connection.
+// Connections wrap fails on are closed and skipped.
+func WrapConn(wrap func(net.Conn) (net.Conn, error)) ListenerMiddleware {
+	return func(l net.Listener) net.Listener {
+		return &wrapListener{Listener: l, wrap: wrap}
+	}
+}
+
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) (net.Conn, error)
+}
+
+func (l *wrapListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := l.wrap(conn)
+		if err != nil {
+			log.Printf("accept %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		return wrapped, nil
+	}
+}
+
+// ProxyProtocol returns the middleware parsing PROXY headers, configure may
+// set the fields of the Listener other than the wrapped one.
+func ProxyProtocol(configure func(l *Listener)) ListenerMiddleware {
+	return func(inner net.Listener) net.Listener {
+		l := &Listener{Listener: inner}
+		if configure != nil {
+			configure(l)
+		}
+		l.Listener = inner
+		return l
+	}
+}
+
+// TLS returns the middleware terminating TLS. Right after ProxyProtocol it is a
+// TLSListener checking the header's TLVs, elsewhere a plain tls.NewListener.
+func TLS(config *tls.Config) ListenerMiddleware {
+	return func(inner net.Listener) net.Listener {
+		if l, ok := inner.(*Listener); ok {
+			return &TLSListener{Listener: l, Config: config}
+		}
+		return tls.NewListener(inner, config)
+	}
+}
+
+// MaxConns returns the middleware bounding the connections open at once, Accept
+// waits for one to close once there are n.
+func MaxConns(n int) ListenerMiddleware {
+	return func(inner net.Listener) net.Listener {
+		return &limitListener{
+			Listener: inner,
+			sem:      make(chan struct{}, n),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{passConn: passConn{socketConn{conn}}, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	passConn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
+
+// LogConns returns the middleware logging every connection when it is accepted
+// and when it closes. It doesn't wait for PROXY headers: accepts are logged with
+// the socket addresses, closes with the proxied ones when the header was read.
+func LogConns() ListenerMiddleware {
+	return WrapConn(func(conn net.Conn) (net.Conn, error) {
+		remote, local := conn.RemoteAddr, conn.LocalAddr
+		if proxyConn, ok := ConnOf(conn); ok {
+			remote, local = proxyConn.Conn.RemoteAddr, proxyConn.Conn.LocalAddr
+		}
+		log.Printf("conn accepted %s -> %s", remote(), local())
+		return &logConn{passConn: passConn{socketConn{conn}}, remote: remote().String(), accepted: time.Now()}, nil
+	})
+}
+
+type logConn struct {
+	passConn
+	remote    string
+	accepted  time.Time
+	closeOnce sync.Once
+}
+
+func (c *logConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		id, remote := "-", c.remote
+		if proxyConn, ok := ConnOf(c.Conn); ok && proxyConn.headerDone.Load() {
+			id, remote = proxyConn.ID(), proxyConn.RemoteAddr().String()
+		}
+		log.Printf("conn %s: %s closed after %v", id, remote, time.Since(c.accepted).Round(time.Millisecond))
+	})
+	return err
+}
+
+// passConn is embedded by connection wrappers which leave the stream untouched.
+// On top of socketConn it passes the copy fast paths through, and Conn looks
+// through it to reach the socket.
+type passConn struct {
+	socketConn
+}
+
+func (c passConn) stream() net.Conn {
+	return c.Conn
+}
+
+// streamOf returns the connection under the passConn wrappers around conn.
+func streamOf(conn net.Conn) net.Conn {
+	for {
+		c, ok := conn.(interface{ stream() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = c.stream()
+	}
+}
+
+// WriteTo implements io.WriterTo, handing the socket to w.ReadFrom so that a
+// *net.TCPConn destination can splice it.
+func (c passConn) WriteTo(w io.Writer) (int64, error) {
+	src := streamOf(c.Conn)
+	if proxyConn, ok := src.(*Conn); ok {
+		return proxyConn.WriteTo(w)
+	}
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w, src)
+}
+
+// ReadFrom implements io.ReaderFrom by writing straight to the wrapped connection.
+func (c passConn) ReadFrom(r io.Reader) (int64, error) {
+	dst := streamOf(c.Conn)
+	if rf, ok := dst.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(dst, r)
+}
+
+// socketConn is embedded by connection wrappers to pass half-close, socket
+// options and SyscallConn through to the wrapped connection.
+type socketConn struct {
+	net.Conn
+}
+
+func (c socketConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c socketConn) CloseWrite() error {
+	if c, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) CloseRead() error {
+	if c, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SetKeepAlive(keepalive bool) error {
+	if c, ok := c.Conn.(interface{ SetKeepAlive(bool) error }); ok {
+		return c.SetKeepAlive(keepalive)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SetKeepAlivePeriod(d time.Duration) error {
+	if c, ok := c.Conn.(interface{ SetKeepAlivePeriod(time.Duration) error }); ok {
+		return c.SetKeepAlivePeriod(d)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SetNoDelay(noDelay bool) error {
+	if c, ok := c.Conn.(interface{ SetNoDelay(bool) error }); ok {
+		return c.SetNoDelay(noDelay)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SetLinger(sec int) error {
+	if c, ok := c.Conn.(interface{ SetLinger(int) error }); ok {
+		return c.SetLinger(sec)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SetReadBuffer(bytes int) error {
+	if c, ok := c.Conn.(interface{ SetReadBuffer(int) error }); ok {
+		return c.SetReadBuffer(bytes)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SetWriteBuffer(bytes int) error {
+	if c, ok := c.Conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return c.SetWriteBuffer(bytes)
+	}
+	return ErrUnsupportedConnOperation
+}
+
+func (c socketConn) SyscallConn() (syscall.RawConn, error) {
+	if c, ok := c.Conn.(syscall.Conn); ok {
+		return c.SyscallConn()
+	}
+	return nil, ErrUnsupportedConnOperation
+}
+
+// StageConfig declares one stage of a chain, see ChainBuilder.
+type StageConfig struct {
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// StageFactory builds the middleware of a stage from its options. It must fail
+// on options it doesn't know.
+type StageFactory func(options StageOptions) (ListenerMiddleware, error)
+
+// ChainBuilder assembles chains from StageConfigs. It knows these stages:
+//
+//	proxy     read_header_timeout, header_workers, max_pending_per_ip, acl (rules file),
+//	          normalize ("unmap"), health_check ("ignore")
+//	tls       cert, key (PEM files), alpn (comma separated)
+//	maxconns  n
+//	log
+type ChainBuilder struct {
+	stages map[string]StageFactory
+}
+
+// NewChainBuilder returns a ChainBuilder knowing the built-in stages.
+func NewChainBuilder() *ChainBuilder {
+	b := &ChainBuilder{stages: make(map[string]StageFactory)}
+	b.Register("proxy", proxyStage)
+	b.Register("tls", tlsStage)
+	b.Register("maxconns", maxConnsStage)
+	b.Register("log", func(options StageOptions) (ListenerMiddleware, error) {
+		return LogConns(), options.done()
+	})
+	return b
+}
+
+// Register adds, or replaces, a stage type.
+func (b *ChainBuilder) Register(name string, factory StageFactory) {
+	b.stages[name] = factory
+}
+
+// Build wraps l with the declared stages, in order.
+func (b *ChainBuilder) Build(l net.Listener, stages []StageConfig) (net.Listener, error) {
+	middlewares := make([]ListenerMiddleware, 0, len(stages))
+	for i, stage := range stages {
+		factory, ok := b.stages[stage.Type]
+		if !ok {
+			return nil, fmt.Errorf("stage %d: unknown type %q", i, stage.Type)
+		}
+		options := StageOptions{values: stage.Options, used: make(map[string]bool)}
+		middleware, err := factory(options)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %w", i, stage.Type, err)
+		}
+		middlewares = append(middlewares, middleware)
+	}
+	return Chain(l, middlewares...), nil
+}
+
+// StageOptions are the options of a stage, read with their typed getters.
+type StageOptions struct {
+	values map[string]string
+	used   map[string]bool
+}
+
+// String returns the option key, or "" when it is unset.
+func (o StageOptions) String(key string) string {
+	o.used[key] = true
+	return o.values[key]
+}
+
+// Int returns the option key, or 0 when it is unset.
+func (o StageOptions) Int(key string) (int, error) {
+	s := o.String(key)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// Duration returns the option key, or 0 when it is unset.
+func (o StageOptions) Duration(key string) (time.Duration, error) {
+	s := o.String(key)
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// done fails when options were given that the stage didn't read.
+func (o StageOptions) done() error {
+	var unknown []string
+	for key := range o.values {
+		if !o.used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown options %s", strings.Join(unknown, ", "))
+}
+
+func proxyStage(options StageOptions) (ListenerMiddleware, error) {
+	timeout, err := options.Duration("read_header_timeout")
+	if err != nil {
+		return nil, err
+	}
+	workers, err := options.Int("header_workers")
+	if err != nil {
+		return nil, err
+	}
+	maxPendingPerIP, err := options.Int("max_pending_per_ip")
+	if err != nil {
+		return nil, err
+	}
+	var acl *ACL
+	if path := options.String("acl"); path != "" {
+		if acl, err = LoadACL(path); err != nil {
+			return nil, err
+		}
+	}
+	var normalize AddrNormalization
+	switch options.String("normalize") {
+	case "":
+	case "unmap":
+		normalize.UnmapIPv4 = true
+	default:
+		return nil, errors.New(`option normalize: expected "unmap"`)
+	}
+	var healthCheck func(*Conn)
+	switch options.String("health_check") {
+	case "":
+	case "ignore":
+		healthCheck = IgnoreHealthCheck
+	default:
+		return nil, errors.New(`option health_check: expected "ignore"`)
+	}
+	if err := options.done(); err != nil {
+		return nil, err
+	}
+
+	return ProxyProtocol(func(l *Listener) {
+		l.ReadHeaderTimeout = timeout
+		l.HeaderWorkers = workers
+		l.MaxPendingPerIP = maxPendingPerIP
+		l.ACL = acl
+		l.Normalize = normalize
+		l.HealthCheck = healthCheck
+	}), nil
+}
+
+func tlsStage(options StageOptions) (ListenerMiddleware, error) {
+	cert, key := options.String("cert"), options.String("key")
+	alpn := options.String("alpn")
+	if err := options.done(); err != nil {
+		return nil, err
+	}
+	if cert == "" || key == "" {
+		return nil, errors.New("options cert and key are required")
+	}
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if alpn != "" {
+		config.NextProtos = strings.Split(alpn, ",")
+	}
+	return TLS(config), nil
+}
+
+func maxConnsStage(options StageOptions) (ListenerMiddleware, error) {
+	n, err := options.Int("n")
+	if err != nil {
+		return nil, err
+	}
+	if err := options.done(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, errors.New("option n must be positive")
+	}
+	return MaxConns(n), nil
+}
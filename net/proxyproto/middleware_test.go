@@ -0,0 +1,263 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var order []string
+	stage := func(name string) ListenerMiddleware {
+		return WrapConn(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, name)
+			return conn, nil
+		})
+	}
+	chain := Chain(l, ProxyProtocol(nil), stage("first"), MaxConns(1), stage("second"))
+	defer chain.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(testV2Header(src, dst))
+		conn.Read(make([]byte, 1))
+	}()
+
+	conn, err := chain.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if strings.Join(order, ",") != "first,second" {
+		t.Fatalf("bad order: %v", order)
+	}
+	if conn.RemoteAddr().String() != src.String() {
+		t.Fatalf("bad remote address: %v", conn.RemoteAddr())
+	}
+	if _, ok := ConnOf(conn); !ok {
+		t.Fatalf("ConnOf didn't find the PROXY connection")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	chain := Chain(l, MaxConns(1))
+	defer chain.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+	}
+
+	first, err := chain.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := chain.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatalf("accepted past the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no accept after a connection closed")
+	}
+}
+
+func TestMaxConnsClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	chain := Chain(l, MaxConns(1))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	first, err := chain.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer first.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := chain.Accept()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	chain.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrListenerClosed) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Accept didn't return after Close")
+	}
+}
+
+func TestChainBuilder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	b := NewChainBuilder()
+	chain, err := b.Build(l, []StageConfig{
+		{Type: "proxy", Options: map[string]string{"read_header_timeout": "1s", "normalize": "unmap"}},
+		{Type: "maxconns", Options: map[string]string{"n": "10"}},
+		{Type: "log"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer chain.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(testV2Header(src, dst))
+		conn.Write([]byte("ping"))
+	}()
+
+	conn, err := chain.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("bad read %q: %v", buf, err)
+	}
+	if conn.RemoteAddr().String() != src.String() {
+		t.Fatalf("bad remote address: %v", conn.RemoteAddr())
+	}
+	if p, ok := ConnOf(conn); !ok || p.readHeaderTimeout != time.Second {
+		t.Fatalf("proxy stage options not applied")
+	}
+}
+
+func TestChainBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []StageConfig
+		err    string
+	}{
+		{"unknown type", []StageConfig{{Type: "gzip"}}, `unknown type "gzip"`},
+		{"unknown option", []StageConfig{{Type: "log", Options: map[string]string{"level": "debug"}}}, "unknown options level"},
+		{"bad duration", []StageConfig{{Type: "proxy", Options: map[string]string{"read_header_timeout": "soon"}}}, "read_header_timeout"},
+		{"bad limit", []StageConfig{{Type: "maxconns", Options: map[string]string{"n": "0"}}}, "positive"},
+		{"missing certificate", []StageConfig{{Type: "tls"}}, "required"},
+	}
+
+	b := NewChainBuilder()
+	for _, tt := range tests {
+		_, err := b.Build(nil, tt.stages)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestChainPassesSocketThrough(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	chain := Chain(l, MaxConns(10), LogConns(), ProxyProtocol(nil))
+	defer chain.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+
+	conn, err := chain.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	proxyConn := conn.(*Conn)
+	if _, ok := proxyConn.socket().(*net.TCPConn); !ok {
+		t.Fatalf("socket hidden behind %T", proxyConn.socket())
+	}
+	if err := proxyConn.SetKeepAlive(true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := proxyConn.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after CloseWrite, got: %v", err)
+	}
+}
+
+func TestLogConnsDoesntReadHeaders(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	chain := Chain(l, ProxyProtocol(nil), LogConns())
+	defer chain.Close()
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer silent.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := chain.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("LogConns waited for the header in Accept")
+	}
+}
@@ -0,0 +1,273 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMuxClosed      = errors.New("proxyproto: mux closed")
+	ErrListenerClosed = errors.New("proxyproto: listener closed")
+)
+
+var (
+	tlsRecordPrefix = []byte{'\x16', '\x03'}
+	http2Preface    = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	http1Methods    = [][]byte{
+		[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+		[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+	}
+)
+
+// DefaultSniffTimeout is used by the Mux when it has no ReadTimeout.
+const DefaultSniffTimeout = 10 * time.Second
+
+// maxHTTP1RequestLine bounds how far MatchHTTP1 looks for the end of the request line.
+const maxHTTP1RequestLine = 4096
+
+// Matcher reports whether a connection belongs to a child listener. It must only
+// Peek at the reader, so that every byte is still delivered to the child.
+type Matcher func(reader *bufio.Reader) bool
+
+// MatchAny matches every connection, it is meant to be registered last.
+func MatchAny() Matcher {
+	return func(*bufio.Reader) bool { return true }
+}
+
+// MatchPrefix matches connections starting with any of the given prefixes.
+func MatchPrefix(prefixes ...[]byte) Matcher {
+	return func(reader *bufio.Reader) bool {
+		for _, prefix := range prefixes {
+			if peekPrefix(reader, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// peekPrefix reports whether the reader starts with prefix. It only waits for
+// more bytes while what has arrived so far still matches, so that short
+// messages of another protocol are not held until the read deadline.
+func peekPrefix(reader *bufio.Reader, prefix []byte) bool {
+	n := 1
+	for {
+		if buffered := reader.Buffered(); buffered > n {
+			n = buffered
+		}
+		if n > len(prefix) {
+			n = len(prefix)
+		}
+		b, err := reader.Peek(n)
+		if err != nil || !bytes.Equal(b, prefix[:n]) {
+			return false
+		}
+		if n == len(prefix) {
+			return true
+		}
+		n++
+	}
+}
+
+// MatchProxy matches connections starting with a v1 or v2 PROXY signature, the
+// same test Read uses to pick a parser.
+func MatchProxy() Matcher {
+	return MatchPrefix(SIGV1, SIGV2)
+}
+
+// MatchTLS matches connections starting with a TLS handshake record.
+func MatchTLS() Matcher {
+	return MatchPrefix(tlsRecordPrefix)
+}
+
+// MatchHTTP2 matches cleartext HTTP/2 (h2c and gRPC) connections by their preface.
+func MatchHTTP2() Matcher {
+	return MatchPrefix(http2Preface)
+}
+
+// MatchHTTP1 matches connections whose request line is a HTTP/1.x one.
+func MatchHTTP1() Matcher {
+	method := MatchPrefix(http1Methods...)
+	return func(reader *bufio.Reader) bool {
+		if !method(reader) {
+			return false
+		}
+		line, ok := peekLine(reader, maxHTTP1RequestLine)
+		if !ok {
+			return false
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		i := bytes.LastIndexByte(line, ' ')
+		return i > 0 && bytes.HasPrefix(line[i+1:], []byte("HTTP/1."))
+	}
+}
+
+// peekLine returns the first line of the reader without consuming it.
+func peekLine(reader *bufio.Reader, max int) ([]byte, bool) {
+	if max > reader.Size() {
+		max = reader.Size()
+	}
+	for n := 1; n <= max; n++ {
+		b, err := reader.Peek(n)
+		if err != nil {
+			return nil, false
+		}
+		if b[n-1] == '\n' {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// Mux serves several protocols from a single listener. Each accepted connection
+// is sniffed with the matchers of the child listeners, in registration order, and
+// handed to the first child that matches, with the sniffed bytes left unread.
+type Mux struct {
+	root net.Listener
+
+	// ReadTimeout bounds how long sniffing may wait for the first bytes,
+	// DefaultSniffTimeout if unset.
+	ReadTimeout time.Duration
+
+	mu       sync.Mutex
+	children []*muxListener
+	donec    chan struct{}
+	closed   bool
+}
+
+// NewMux returns a Mux accepting connections from l.
+func NewMux(l net.Listener) *Mux {
+	return &Mux{
+		root:  l,
+		donec: make(chan struct{}),
+	}
+}
+
+// Match returns a child listener receiving the connections accepted by any of
+// the matchers.
+func (m *Mux) Match(matchers ...Matcher) net.Listener {
+	child := &muxListener{
+		addr:     m.root.Addr(),
+		matchers: matchers,
+		connc:    make(chan net.Conn),
+		donec:    make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.children = append(m.children, child)
+	m.mu.Unlock()
+	return child
+}
+
+// Serve accepts connections until the root listener fails or the Mux is closed.
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.root.Accept()
+		if err != nil {
+			select {
+			case <-m.donec:
+				return ErrMuxClosed
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go m.dispatch(conn)
+	}
+}
+
+// Close closes the root listener and every child listener.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.donec)
+	children := m.children
+	m.mu.Unlock()
+
+	for _, child := range children {
+		child.Close()
+	}
+	return m.root.Close()
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	timeout := m.ReadTimeout
+	if timeout <= 0 {
+		timeout = DefaultSniffTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+
+	m.mu.Lock()
+	children := m.children
+	m.mu.Unlock()
+
+	for _, child := range children {
+		for _, match := range child.matchers {
+			if !match(reader) {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			if !child.deliver(&muxConn{socketConn: socketConn{conn}, reader: reader}) {
+				conn.Close()
+			}
+			return
+		}
+	}
+	conn.Close()
+}
+
+type muxListener struct {
+	addr     net.Addr
+	matchers []Matcher
+	connc    chan net.Conn
+	donec    chan struct{}
+	once     sync.Once
+}
+
+func (l *muxListener) deliver(conn net.Conn) bool {
+	select {
+	case l.connc <- conn:
+		return true
+	case <-l.donec:
+		return false
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connc:
+		return conn, nil
+	case <-l.donec:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() { close(l.donec) })
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.addr
+}
+
+// muxConn replays the bytes buffered while sniffing before reading from the socket.
+type muxConn struct {
+	socketConn
+	reader *bufio.Reader
+}
+
+func (c *muxConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
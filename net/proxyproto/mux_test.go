@@ -0,0 +1,144 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMuxDispatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mux := NewMux(l)
+	mux.ReadTimeout = time.Second
+	proxyL := mux.Match(MatchProxy())
+	tlsL := mux.Match(MatchTLS())
+	h2L := mux.Match(MatchHTTP2())
+	h1L := mux.Match(MatchHTTP1())
+	anyL := mux.Match(MatchAny())
+	go mux.Serve()
+	defer mux.Close()
+
+	tests := []struct {
+		name     string
+		listener net.Listener
+		payload  []byte
+	}{
+		{"proxy v1", proxyL, []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\nHELO")},
+		{"proxy v2", proxyL, append(append([]byte{}, SIGV2...), '\x20', '\x00', '\x00', '\x00')},
+		{"tls", tlsL, []byte{'\x16', '\x03', '\x01', '\x00', '\x05', 'h', 'e', 'l', 'l', 'o'}},
+		{"h2c", h2L, append(append([]byte{}, http2Preface...), '\x00')},
+		{"http1", h1L, []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")},
+		{"custom", anyL, []byte("HELO localhost\r\n")},
+	}
+
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if _, err := conn.Write(tt.payload); err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+
+		accepted, err := tt.listener.Accept()
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		recv := make([]byte, len(tt.payload))
+		if _, err := io.ReadFull(accepted, recv); err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if !bytes.Equal(recv, tt.payload) {
+			t.Fatalf("%s: bad: %q", tt.name, recv)
+		}
+		accepted.Close()
+		conn.Close()
+	}
+}
+
+func TestMuxNoMatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mux := NewMux(l)
+	mux.ReadTimeout = time.Second
+	mux.Match(MatchTLS())
+	go mux.Serve()
+	defer mux.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got: %v", err)
+	}
+}
+
+func TestMuxCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mux := NewMux(l)
+	anyL := mux.Match(MatchAny())
+	go mux.Serve()
+	defer mux.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	accepted, err := anyL.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer accepted.Close()
+	cw, ok := accepted.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("expected CloseWrite on %T", accepted)
+	}
+	if _, ok := accepted.(syscall.Conn); !ok {
+		t.Fatalf("expected SyscallConn on %T", accepted)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after CloseWrite, got: %v", err)
+	}
+	// The read side stays open and still replays the sniffed bytes.
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv := make([]byte, 8)
+	if _, err := io.ReadFull(accepted, recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(recv) != "pingpong" {
+		t.Fatalf("bad: %q", recv)
+	}
+}
@@ -0,0 +1,116 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var (
+	ErrZoneNotAllowed = errors.New("proxyproto: IPv6 zone not allowed in address")
+)
+
+// ZoneHandling selects what happens to IPv6 zones (fe80::1%eth0) of parsed
+// addresses. Only v1 headers can carry one.
+type ZoneHandling int
+
+const (
+	// ZoneKeep leaves zones in place.
+	ZoneKeep ZoneHandling = iota
+	// ZoneStrip drops zones.
+	ZoneStrip
+	// ZoneReject fails headers carrying a zone with ErrZoneNotAllowed.
+	ZoneReject
+)
+
+// AddrNormalization rewrites the addresses of a parsed header into one canonical
+// form. The zero value leaves them as parsed.
+type AddrNormalization struct {
+	// UnmapIPv4 turns IPv4-mapped IPv6 addresses (::ffff:10.1.1.1) into plain IPv4
+	// ones and stores every IPv4 address in its 4-byte form. TransportProtocol
+	// still describes what was on the wire.
+	UnmapIPv4 bool
+	Zone      ZoneHandling
+}
+
+// Normalize rewrites the source and destination addresses of the header.
+func (header *Header) Normalize(n AddrNormalization) error {
+	sourceAddr, err := normalizeAddr(header.SourceAddr, n)
+	if err != nil {
+		return err
+	}
+	destAddr, err := normalizeAddr(header.DestinationAddr, n)
+	if err != nil {
+		return err
+	}
+	header.SourceAddr, header.DestinationAddr = sourceAddr, destAddr
+	return nil
+}
+
+func normalizeAddr(addr net.Addr, n AddrNormalization) (net.Addr, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, zone, err := normalizeIP(a.IP, a.Zone, n)
+		if err != nil {
+			return nil, err
+		}
+		return &net.TCPAddr{IP: ip, Port: a.Port, Zone: zone}, nil
+	case *net.UDPAddr:
+		ip, zone, err := normalizeIP(a.IP, a.Zone, n)
+		if err != nil {
+			return nil, err
+		}
+		return &net.UDPAddr{IP: ip, Port: a.Port, Zone: zone}, nil
+	default:
+		return addr, nil
+	}
+}
+
+func normalizeIP(ip net.IP, zone string, n AddrNormalization) (net.IP, string, error) {
+	if n.UnmapIPv4 {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, zone = ip4, ""
+		}
+	}
+
+	switch n.Zone {
+	case ZoneStrip:
+		zone = ""
+	case ZoneReject:
+		if zone != "" {
+			return nil, "", ErrZoneNotAllowed
+		}
+	}
+	return ip, zone, nil
+}
+
+// SourceAddrPort returns the source address as a netip.AddrPort, when it is an IP one.
+func (header *Header) SourceAddrPort() (netip.AddrPort, bool) {
+	return addrPort(header.SourceAddr)
+}
+
+// DestinationAddrPort returns the destination address as a netip.AddrPort, when it is an IP one.
+func (header *Header) DestinationAddrPort() (netip.AddrPort, bool) {
+	return addrPort(header.DestinationAddr)
+}
+
+// RemoteAddrPort is RemoteAddr as a netip.AddrPort, when it is an IP one.
+func (p *Conn) RemoteAddrPort() (netip.AddrPort, bool) {
+	return addrPort(p.RemoteAddr())
+}
+
+// LocalAddrPort is LocalAddr as a netip.AddrPort, when it is an IP one.
+func (p *Conn) LocalAddrPort() (netip.AddrPort, bool) {
+	return addrPort(p.LocalAddr())
+}
+
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort(), true
+	case *net.UDPAddr:
+		return a.AddrPort(), true
+	default:
+		return netip.AddrPort{}, false
+	}
+}
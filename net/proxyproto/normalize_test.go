@@ -0,0 +1,80 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		n      AddrNormalization
+		src    string
+		err    error
+	}{
+		{"as parsed", "PROXY TCP6 ::ffff:10.1.1.1 ::1 1000 2000\r\n", AddrNormalization{}, "[::ffff:10.1.1.1]:1000", nil},
+		{"unmap", "PROXY TCP6 ::ffff:10.1.1.1 ::1 1000 2000\r\n", AddrNormalization{UnmapIPv4: true}, "10.1.1.1:1000", nil},
+		{"keep zone", "PROXY TCP6 fe80::1%eth0 ::1 1000 2000\r\n", AddrNormalization{}, "[fe80::1%eth0]:1000", nil},
+		{"strip zone", "PROXY TCP6 fe80::1%eth0 ::1 1000 2000\r\n", AddrNormalization{Zone: ZoneStrip}, "[fe80::1]:1000", nil},
+		{"reject zone", "PROXY TCP6 fe80::1%eth0 ::1 1000 2000\r\n", AddrNormalization{Zone: ZoneReject}, "", ErrZoneNotAllowed},
+	}
+
+	for _, tt := range tests {
+		header, err := Read(bufio.NewReader(bytes.NewReader([]byte(tt.header))))
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		err = header.Normalize(tt.n)
+		if err != tt.err {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		src, ok := header.SourceAddrPort()
+		if !ok || src.String() != tt.src {
+			t.Fatalf("%s: bad: %v", tt.name, src)
+		}
+	}
+}
+
+func TestNormalizeListener(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l, Normalize: AddrNormalization{UnmapIPv4: true}}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(testV2Header(src, dst))
+		conn.Read(make([]byte, 1))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	remote, ok := conn.(*Conn).RemoteAddrPort()
+	if !ok || remote != netip.MustParseAddrPort("10.1.1.1:1000") {
+		t.Fatalf("bad: %v", remote)
+	}
+	local, ok := conn.(*Conn).LocalAddrPort()
+	if !ok || local.Addr() != netip.MustParseAddr("20.2.2.2") {
+		t.Fatalf("bad: %v", local)
+	}
+}
@@ -0,0 +1,143 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPendingShed = errors.New("proxyproto: too many connections waiting for their header")
+)
+
+// DefaultReadHeaderTimeout is used by the header workers when the Listener has no ReadHeaderTimeout.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// headerPool reads headers of accepted connections in a bounded set of workers,
+// so that one slow client can't hold Accept for everyone else.
+type headerPool struct {
+	listener *Listener
+	pending  chan *Conn
+	ready    chan *Conn
+	errc     chan error
+	done     chan struct{}
+	once     sync.Once
+}
+
+// DefaultHeaderWorkers is used when the Listener needs headers before Accept, for
+// HealthCheck, ACL or Limiter, and has no HeaderWorkers.
+const DefaultHeaderWorkers = 64
+
+func (l *Listener) startPool() {
+	workers := l.HeaderWorkers
+	if workers <= 0 {
+		if l.HealthCheck == nil && l.ACL == nil && l.Limiter == nil {
+			return
+		}
+		workers = DefaultHeaderWorkers
+	}
+
+	maxPending := l.MaxPendingHeaders
+	if maxPending <= 0 {
+		maxPending = workers
+	}
+	pool := &headerPool{
+		listener: l,
+		pending:  make(chan *Conn, maxPending),
+		ready:    make(chan *Conn),
+		errc:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	go pool.accept()
+	l.pool = pool
+}
+
+func (pool *headerPool) accept() {
+	timeout := pool.listener.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultReadHeaderTimeout
+	}
+
+	for {
+		conn, err := pool.listener.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			pool.errc <- err
+			return
+		}
+
+		newConn, ok := pool.listener.newConn(conn)
+		if !ok {
+			continue
+		}
+		newConn.readHeaderTimeout = timeout
+		select {
+		case pool.pending <- newConn:
+		default:
+			// Too many handshakes in flight, shed the new one.
+			if pool.listener.Metrics != nil {
+				pool.listener.Metrics.PendingShed.Add(1)
+			}
+			newConn.access.fail(ErrPendingShed)
+			newConn.Close()
+		}
+	}
+}
+
+func (pool *headerPool) work() {
+	for {
+		select {
+		case conn := <-pool.pending:
+			conn.once.Do(func() { conn.readErr = conn.readHeader() })
+			if conn.readErr != nil && conn.readErr != ErrNoProxyProtocol {
+				conn.Close()
+				continue
+			}
+			if pool.listener.HealthCheck != nil && conn.isHealthCheck() {
+				pool.listener.answerHealthCheck(conn)
+				continue
+			}
+			if !pool.listener.admit(conn) {
+				continue
+			}
+			select {
+			case pool.ready <- conn:
+			case <-pool.done:
+				conn.Close()
+			}
+		case <-pool.done:
+			for {
+				select {
+				case conn := <-pool.pending:
+					conn.Close()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (pool *headerPool) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pool.ready:
+		return conn, nil
+	case err := <-pool.errc:
+		// Keep the error for later calls.
+		pool.errc <- err
+		return nil, err
+	case <-pool.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (pool *headerPool) close() {
+	pool.once.Do(func() { close(pool.done) })
+}
@@ -0,0 +1,244 @@
+package proxyproto
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited           = errors.New("proxyproto: client over its connection rate")
+	ErrTooManyConnsPerClient = errors.New("proxyproto: client over its connection limit")
+)
+
+// ClientLimits bounds the connections of each client, a client being every
+// source address within the same aggregation prefix.
+type ClientLimits struct {
+	// IPv4Prefix and IPv6Prefix are the prefix lengths sources are aggregated on,
+	// for example 24 and 64. Zero means a single address.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// Rate bounds the new connections per second of a client, with bursts of up to
+	// Burst connections (at least 1). Zero means no limit.
+	Rate  float64
+	Burst int
+	// MaxConns bounds the open connections of a client, zero means no limit.
+	MaxConns int
+
+	// Delay, when positive, holds connections over Rate until the client is back
+	// within it, if that takes no longer than Delay, instead of closing them. The
+	// hold happens on the first read, Accept is not held up.
+	Delay time.Duration
+}
+
+// ClientBucket is the state of the limits of one client.
+type ClientBucket struct {
+	Prefix netip.Prefix
+	// Tokens is the number of connections the client may open right now, it is
+	// negative while delayed connections are pending.
+	Tokens float64
+	Conns  int
+}
+
+// ClientLimiter applies ClientLimits to the sources of a Listener's connections,
+// which are the ones of the PROXY header when there is one. Connections without
+// an IP source aren't limited.
+type ClientLimiter struct {
+	limits ClientLimits
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[netip.Prefix]*clientBucket
+	sweepSize int
+}
+
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+// NewClientLimiter returns a ClientLimiter applying limits.
+func NewClientLimiter(limits ClientLimits) *ClientLimiter {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	return &ClientLimiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: make(map[netip.Prefix]*clientBucket),
+	}
+}
+
+// Prefix returns the client addr is aggregated into.
+func (l *ClientLimiter) Prefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap().WithZone("")
+	bits := l.limits.IPv6Prefix
+	if addr.Is4() {
+		bits = l.limits.IPv4Prefix
+	}
+	if bits <= 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// Buckets returns the clients currently tracked, sorted by prefix.
+func (l *ClientLimiter) Buckets() []ClientBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	buckets := make([]ClientBucket, 0, len(l.buckets))
+	for prefix, b := range l.buckets {
+		l.refill(b, now)
+		buckets = append(buckets, ClientBucket{Prefix: prefix, Tokens: b.tokens, Conns: b.conns})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i].Prefix, buckets[j].Prefix
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+	return buckets
+}
+
+// limitError tells why acquire turned a connection away.
+type limitError int
+
+const (
+	limitNone limitError = iota
+	limitRate
+	limitConns
+)
+
+// acquire admits a connection from addr. It returns how long the connection must
+// be held, and a release function to call once it closes.
+func (l *ClientLimiter) acquire(addr netip.Addr) (time.Duration, func(), limitError) {
+	prefix := l.Prefix(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[prefix]
+	if !ok {
+		b = &clientBucket{tokens: float64(l.limits.Burst), last: now}
+		l.buckets[prefix] = b
+	}
+	l.refill(b, now)
+
+	if l.limits.MaxConns > 0 && b.conns >= l.limits.MaxConns {
+		return 0, nil, limitConns
+	}
+
+	var wait time.Duration
+	if l.limits.Rate > 0 {
+		if b.tokens < 1 {
+			wait = time.Duration((1 - b.tokens) / l.limits.Rate * float64(time.Second))
+			if wait > l.limits.Delay {
+				return 0, nil, limitRate
+			}
+		}
+		b.tokens--
+	}
+
+	b.conns++
+	var once sync.Once
+	return wait, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			b.conns--
+		})
+	}, limitNone
+}
+
+func (l *ClientLimiter) refill(b *clientBucket, now time.Time) {
+	if l.limits.Rate <= 0 {
+		b.last = now
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.limits.Rate
+	if burst := float64(l.limits.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// sweep drops the buckets of idle clients, whenever the number of buckets has
+// doubled since the last sweep.
+func (l *ClientLimiter) sweep(now time.Time) {
+	if len(l.buckets) < 2*l.sweepSize || len(l.buckets) < 64 {
+		return
+	}
+	for prefix, b := range l.buckets {
+		l.refill(b, now)
+		if b.conns == 0 && b.tokens >= float64(l.limits.Burst) {
+			delete(l.buckets, prefix)
+		}
+	}
+	l.sweepSize = len(l.buckets)
+}
+
+// limit checks the source of conn against the listener's ClientLimiter, it closes
+// the connection and returns false when it is over the limits.
+func (l *Listener) limit(conn *Conn) bool {
+	if l.Limiter == nil {
+		return true
+	}
+	src, ok := conn.RemoteAddrPort()
+	if !ok {
+		return true
+	}
+
+	wait, release, limited := l.Limiter.acquire(src.Addr())
+	switch limited {
+	case limitNone:
+		conn.onClose = release
+		if wait > 0 {
+			conn.notBefore = time.Now().Add(wait)
+		}
+		return true
+	case limitRate:
+		if l.Metrics != nil {
+			l.Metrics.RateLimited.Add(1)
+		}
+		conn.access.fail(ErrRateLimited)
+	case limitConns:
+		if l.Metrics != nil {
+			l.Metrics.TooManyConnsPerClient.Add(1)
+		}
+		conn.access.fail(ErrTooManyConnsPerClient)
+	}
+	conn.Close()
+	return false
+}
+
+// waitAdmission holds reads of a connection delayed by the ClientLimiter, until
+// it is due or the listener closes.
+func (p *Conn) waitAdmission() {
+	if p.notBefore.IsZero() {
+		return
+	}
+	wait := time.Until(p.notBefore)
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	if p.ctx == nil {
+		<-timer.C
+		return
+	}
+	select {
+	case <-timer.C:
+	case <-p.ctx.Done():
+	}
+}
@@ -0,0 +1,133 @@
+package proxyproto
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewClientLimiter(ClientLimits{IPv4Prefix: 24, IPv6Prefix: 64, Rate: 1, Burst: 2, MaxConns: 3})
+	l.now = func() time.Time { return now }
+
+	if p := l.Prefix(netip.MustParseAddr("::ffff:10.1.1.9")); p.String() != "10.1.1.0/24" {
+		t.Fatalf("bad: %v", p)
+	}
+	if p := l.Prefix(netip.MustParseAddr("2001:db8::1")); p.String() != "2001:db8::/64" {
+		t.Fatalf("bad: %v", p)
+	}
+
+	var releases []func()
+	for i, addr := range []string{"10.1.1.1", "10.1.1.2"} {
+		_, release, limited := l.acquire(netip.MustParseAddr(addr))
+		if limited != limitNone {
+			t.Fatalf("%d: unexpected limit %d", i, limited)
+		}
+		releases = append(releases, release)
+	}
+	// The /24 has used its burst, other clients are unaffected.
+	if _, _, limited := l.acquire(netip.MustParseAddr("10.1.1.3")); limited != limitRate {
+		t.Fatalf("expected rate limit, got %d", limited)
+	}
+	if _, _, limited := l.acquire(netip.MustParseAddr("10.1.2.1")); limited != limitNone {
+		t.Fatalf("unexpected limit %d", limited)
+	}
+
+	now = now.Add(time.Second)
+	_, release, limited := l.acquire(netip.MustParseAddr("10.1.1.4"))
+	if limited != limitNone {
+		t.Fatalf("unexpected limit %d", limited)
+	}
+	releases = append(releases, release)
+
+	// Three connections of 10.1.1.0/24 are open.
+	now = now.Add(time.Minute)
+	if _, _, limited := l.acquire(netip.MustParseAddr("10.1.1.5")); limited != limitConns {
+		t.Fatalf("expected connection limit, got %d", limited)
+	}
+	releases[0]()
+	releases[0]()
+	if _, _, limited := l.acquire(netip.MustParseAddr("10.1.1.5")); limited != limitNone {
+		t.Fatalf("unexpected limit %d", limited)
+	}
+
+	buckets := l.Buckets()
+	if len(buckets) != 2 || buckets[0].Prefix.String() != "10.1.1.0/24" || buckets[0].Conns != 3 || buckets[1].Conns != 1 {
+		t.Fatalf("bad: %+v", buckets)
+	}
+}
+
+func TestClientLimiterDelay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewClientLimiter(ClientLimits{Rate: 10, Delay: 150 * time.Millisecond})
+	l.now = func() time.Time { return now }
+
+	addr := netip.MustParseAddr("10.1.1.1")
+	waits := []time.Duration{0, 100 * time.Millisecond}
+	for _, expected := range waits {
+		wait, _, limited := l.acquire(addr)
+		if limited != limitNone || wait != expected {
+			t.Fatalf("bad: %v %d", wait, limited)
+		}
+	}
+	// The next one would have to wait 200ms.
+	if _, _, limited := l.acquire(addr); limited != limitRate {
+		t.Fatalf("expected rate limit, got %d", limited)
+	}
+	if buckets := l.Buckets(); buckets[0].Tokens != -1 {
+		t.Fatalf("bad: %+v", buckets)
+	}
+}
+
+func TestListenerLimiter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	metrics := &Metrics{}
+	pl := &Listener{Listener: l, Limiter: NewClientLimiter(ClientLimits{MaxConns: 1}), Metrics: metrics}
+	defer pl.Close()
+
+	dial := func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"))
+	}
+
+	dial()
+	first, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The second connection is closed while the first is open.
+	acceptc := make(chan net.Conn)
+	go func() {
+		conn, err := pl.Accept()
+		if err == nil {
+			acceptc <- conn
+		}
+	}()
+	dial()
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.TooManyConnsPerClient.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if metrics.TooManyConnsPerClient.Load() != 1 {
+		t.Fatal("expected a connection to be limited")
+	}
+
+	first.Close()
+	dial()
+	select {
+	case conn := <-acceptc:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out accepting")
+	}
+}
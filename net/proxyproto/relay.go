@@ -0,0 +1,154 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Relay forwards connections accepted by a PROXY Listener to a next hop,
+// replaying their header first so that the backend sees the first client's
+// address rather than this proxy's.
+type Relay struct {
+	// Target is the TCP address of the next hop.
+	Target string
+	// DialTimeout bounds connecting to Target, zero means no limit.
+	DialTimeout time.Duration
+	// Version is used when the incoming connection has no header and one is
+	// built from its socket addresses. Defaults to 2.
+	Version byte
+	// HopTLVs, when set, returns TLVs appended to the forwarded header. The header
+	// is then re-encoded as v2 instead of being forwarded byte for byte.
+	HopTLVs func(conn *Conn) []TLV
+	// UniqueID adds the connection's ID as a PP2_TYPE_UNIQUE_ID TLV to forwarded
+	// headers lacking one, so that the next hop logs the same ID.
+	UniqueID bool
+	// Rewrite transforms the addresses of forwarded headers, which are then
+	// re-encoded in their own version unless TLVs are added.
+	Rewrite RewriteRules
+}
+
+// Serve relays every connection accepted from l until it fails.
+func (r *Relay) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := r.ServeConn(conn); err != nil {
+				log.Printf("relay %s %s: %v", connID(conn), conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn relays a single connection and closes it when either side is done.
+func (r *Relay) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	proxyConn, ok := conn.(*Conn)
+	if !ok {
+		proxyConn = NewConn(conn)
+	}
+
+	header, err := r.forwardHeader(proxyConn)
+	if err != nil {
+		return err
+	}
+
+	backend, err := net.DialTimeout("tcp", r.Target, r.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	if _, err := backend.Write(header); err != nil {
+		return err
+	}
+	return pipe(proxyConn, backend)
+}
+
+// forwardHeader returns the header bytes sent to the next hop.
+func (r *Relay) forwardHeader(conn *Conn) ([]byte, error) {
+	header := conn.ProxyHeader()
+	synthesized := header == nil
+	if synthesized {
+		if conn.readErr != nil && conn.readErr != ErrNoProxyProtocol {
+			return nil, conn.readErr
+		}
+		version := r.Version
+		if version == 0 {
+			version = 2
+		}
+		header = HeaderFromAddrs(version, conn.Conn.RemoteAddr(), conn.Conn.LocalAddr())
+	}
+
+	var hopTLVs []TLV
+	if r.HopTLVs != nil {
+		hopTLVs = r.HopTLVs(conn)
+	}
+	if _, ok := header.FindTLV(PP2_TYPE_UNIQUE_ID); r.UniqueID && !ok {
+		hopTLVs = append(hopTLVs, TLV{Type: PP2_TYPE_UNIQUE_ID, Value: []byte(conn.ID())})
+	}
+
+	if len(r.Rewrite) > 0 {
+		var err error
+		if header, err = r.Rewrite.Apply(header); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.HopTLVs == nil && len(hopTLVs) == 0 {
+		if synthesized || len(r.Rewrite) > 0 {
+			return header.Format()
+		}
+		return header.Raw(), nil
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return nil, err
+	}
+	forwarded := *header
+	forwarded.Version = 2
+	if err := forwarded.SetTLVs(append(tlvs, hopTLVs...)); err != nil {
+		return nil, err
+	}
+	return forwarded.Format()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data both ways until both directions are done, half-closing each
+// side once its peer stops sending.
+func pipe(a, b net.Conn) error {
+	var wg sync.WaitGroup
+	errc := make(chan error, 2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); !ok || cw.CloseWrite() != nil {
+			dst.Close()
+		}
+		errc <- err
+	}
+
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	close(errc)
+
+	for err := range errc {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// startRelay relays connections accepted on a new PROXY listener to target.
+func startRelay(t *testing.T, relay *Relay) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	go relay.Serve(pl)
+	t.Cleanup(func() { pl.Close() })
+	return pl
+}
+
+func TestRelayChain(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: backend}
+	defer pl.Close()
+
+	second := startRelay(t, &Relay{
+		Target: backend.Addr().String(),
+		HopTLVs: func(*Conn) []TLV {
+			return []TLV{{PP2_TYPE_NETNS, []byte("hop-2")}}
+		},
+	})
+	first := startRelay(t, &Relay{Target: second.Addr().String()})
+
+	tests := []struct {
+		name   string
+		header []byte
+		source string
+	}{
+		{"v1 header", []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n"), "10.1.1.1:1000"},
+		{"no header", nil, "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		client, err := net.Dial("tcp", first.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		client.Write(append(tt.header, "ping"...))
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		proxyConn := conn.(*Conn)
+		recv := make([]byte, 4)
+		if _, err := io.ReadFull(conn, recv); err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if !bytes.Equal(recv, []byte("ping")) {
+			t.Fatalf("%s: bad: %q", tt.name, recv)
+		}
+
+		source := conn.RemoteAddr().String()
+		if tt.header == nil {
+			// The first relay reports the client's own socket address.
+			source, _, _ = net.SplitHostPort(source)
+			if source != tt.source || conn.RemoteAddr().String() != client.LocalAddr().String() {
+				t.Fatalf("%s: bad remote address: %v", tt.name, conn.RemoteAddr())
+			}
+		} else if source != tt.source {
+			t.Fatalf("%s: bad remote address: %v", tt.name, source)
+		}
+		if hop, ok := proxyConn.TLV(PP2_TYPE_NETNS); !ok || string(hop) != "hop-2" {
+			t.Fatalf("%s: bad hop TLV: %q", tt.name, hop)
+		}
+
+		// Data flows back and half-closes propagate through both relays.
+		conn.Write([]byte("pong"))
+		conn.Close()
+		recv, err = io.ReadAll(client)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if !bytes.Equal(recv, []byte("pong")) {
+			t.Fatalf("%s: bad: %q", tt.name, recv)
+		}
+		client.Close()
+	}
+}
+
+func TestRelayForwardsRawHeader(t *testing.T) {
+	raw := []byte("PROXY TCP6 fde7::372 fde7::1 1000 2000\r\n")
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write(raw)
+
+	header, err := (&Relay{}).forwardHeader(NewConn(server))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(header, raw) {
+		t.Fatalf("bad: %q", header)
+	}
+}
+
+// benchmarkRelay measures relaying a stream from a client to a sink through a
+// proxy that copies from wrap(accepted connection) to the sink.
+func benchmarkRelay(b *testing.B, header []byte, wrap func(net.Conn) net.Conn) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer sink.Close()
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer proxy.Close()
+
+	done := make(chan int64)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close()
+		done <- n
+	}()
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		backend, err := net.Dial("tcp", sink.Addr().String())
+		if err != nil {
+			return
+		}
+		io.Copy(backend, wrap(conn))
+		backend.Close()
+		conn.Close()
+	}()
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+
+	client, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	client.Write(header)
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+	client.Close()
+	if n := <-done; n != int64(b.N*len(chunk)) {
+		b.Fatalf("relayed %d bytes, expected %d", n, b.N*len(chunk))
+	}
+}
+
+func BenchmarkRelayRawTCP(b *testing.B) {
+	benchmarkRelay(b, nil, func(conn net.Conn) net.Conn { return conn })
+}
+
+func BenchmarkRelayConn(b *testing.B) {
+	header := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+	benchmarkRelay(b, header, func(conn net.Conn) net.Conn { return NewConn(conn) })
+}
+
+// BenchmarkRelayConnNoFastPath copies through Read only, the baseline WriteTo improves on.
+func BenchmarkRelayConnNoFastPath(b *testing.B) {
+	header := []byte("PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n")
+	benchmarkRelay(b, header, func(conn net.Conn) net.Conn { return readOnlyConn{NewConn(conn)} })
+}
+
+type readOnlyConn struct {
+	net.Conn
+}
+
+func TestFormatVersion1MappedAddresses(t *testing.T) {
+	header := &Header{
+		Version:           1,
+		Command:           PROXY,
+		TransportProtocol: TCPv6,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.1.1"), Port: 1000},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2000},
+	}
+	raw, err := header.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := "PROXY TCP6 ::ffff:10.1.1.1 2001:db8::1 1000 2000\r\n"; string(raw) != expected {
+		t.Fatalf("formatted %q, expected %q", raw, expected)
+	}
+	if _, err := Read(bufio.NewReader(bytes.NewReader(raw))); err != nil {
+		t.Fatalf("%q: err: %v", raw, err)
+	}
+}
@@ -0,0 +1,272 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidRewriteRule = errors.New("proxyproto: invalid rewrite rule")
+)
+
+// RewriteField selects the address a RewriteRule applies to.
+type RewriteField int
+
+const (
+	RewriteSource RewriteField = iota
+	RewriteDestination
+)
+
+// RewriteAction is what a RewriteRule does to an address.
+type RewriteAction int
+
+const (
+	// RewriteMask zeroes all but the first Bits4 bits of IPv4 addresses and Bits6
+	// bits of IPv6 ones, a zero count leaves that family alone.
+	RewriteMask RewriteAction = iota
+	// RewriteNAT64 embeds IPv4 addresses in the /96 Prefix, as in RFC 6052.
+	RewriteNAT64
+	// RewriteNAT46 extracts the IPv4 address embedded in IPv6 addresses within the
+	// /96 Prefix.
+	RewriteNAT46
+	// RewriteSet replaces the address with Addr, and the port too unless Addr's is 0.
+	RewriteSet
+)
+
+// RewriteRule transforms the source or destination address of a header.
+type RewriteRule struct {
+	Field  RewriteField
+	Action RewriteAction
+	// If, when valid, restricts the rule to addresses within it.
+	If netip.Prefix
+
+	Bits4, Bits6 int
+	Prefix       netip.Prefix
+	Addr         netip.AddrPort
+}
+
+func (rule *RewriteRule) validate() error {
+	switch rule.Action {
+	case RewriteMask:
+		if rule.Bits4 < 0 || rule.Bits4 > 32 || rule.Bits6 < 0 || rule.Bits6 > 128 {
+			return ErrInvalidRewriteRule
+		}
+	case RewriteNAT64, RewriteNAT46:
+		if !rule.Prefix.Addr().Is6() || rule.Prefix.Bits() != 96 {
+			return ErrInvalidRewriteRule
+		}
+	case RewriteSet:
+		if !rule.Addr.Addr().IsValid() {
+			return ErrInvalidRewriteRule
+		}
+	default:
+		return ErrInvalidRewriteRule
+	}
+	return nil
+}
+
+func (rule *RewriteRule) apply(ap netip.AddrPort) netip.AddrPort {
+	addr, port := ap.Addr().Unmap(), ap.Port()
+	if rule.If.IsValid() && !rule.If.Contains(addr) {
+		return ap
+	}
+
+	switch rule.Action {
+	case RewriteMask:
+		bits := rule.Bits6
+		if addr.Is4() {
+			bits = rule.Bits4
+		}
+		if bits > 0 {
+			prefix, _ := addr.Prefix(bits)
+			addr = prefix.Addr()
+		}
+	case RewriteNAT64:
+		if addr.Is4() {
+			b, v4 := rule.Prefix.Addr().As16(), addr.As4()
+			copy(b[12:], v4[:])
+			addr = netip.AddrFrom16(b)
+		}
+	case RewriteNAT46:
+		if addr.Is6() && rule.Prefix.Contains(addr) {
+			b := addr.As16()
+			addr = netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]})
+		}
+	case RewriteSet:
+		addr = rule.Addr.Addr()
+		if rule.Addr.Port() != 0 {
+			port = rule.Addr.Port()
+		}
+	}
+	return netip.AddrPortFrom(addr, port)
+}
+
+// RewriteRules are applied in order to the addresses of forwarded headers.
+type RewriteRules []*RewriteRule
+
+// ParseRewriteRules reads rules, one per line, in the form
+//
+//	src|dst mask <bits4> [<bits6>] [if <prefix>]
+//	src|dst nat64|nat46 <prefix/96> [if <prefix>]
+//	src|dst set <addr>|<addr:port> [if <prefix>]
+//
+// Blank lines and lines starting with # are skipped.
+func ParseRewriteRules(r io.Reader) (RewriteRules, error) {
+	var rules RewriteRules
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRewriteRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseRewriteRule(fields []string) (*RewriteRule, error) {
+	rule := &RewriteRule{}
+	if n := len(fields); n >= 2 && fields[n-2] == "if" {
+		prefix, err := netip.ParsePrefix(fields[n-1])
+		if err != nil {
+			return nil, ErrInvalidRewriteRule
+		}
+		rule.If = prefix.Masked()
+		fields = fields[:n-2]
+	}
+	if len(fields) < 3 {
+		return nil, ErrInvalidRewriteRule
+	}
+
+	switch fields[0] {
+	case "src":
+		rule.Field = RewriteSource
+	case "dst":
+		rule.Field = RewriteDestination
+	default:
+		return nil, ErrInvalidRewriteRule
+	}
+
+	var err error
+	args := fields[2:]
+	switch fields[1] {
+	case "mask":
+		rule.Action = RewriteMask
+		if len(args) > 2 {
+			return nil, ErrInvalidRewriteRule
+		}
+		if rule.Bits4, err = strconv.Atoi(args[0]); err != nil {
+			return nil, ErrInvalidRewriteRule
+		}
+		if len(args) == 2 {
+			if rule.Bits6, err = strconv.Atoi(args[1]); err != nil {
+				return nil, ErrInvalidRewriteRule
+			}
+		}
+	case "nat64", "nat46":
+		rule.Action = RewriteNAT64
+		if fields[1] == "nat46" {
+			rule.Action = RewriteNAT46
+		}
+		if len(args) != 1 {
+			return nil, ErrInvalidRewriteRule
+		}
+		if rule.Prefix, err = netip.ParsePrefix(args[0]); err != nil {
+			return nil, ErrInvalidRewriteRule
+		}
+	case "set":
+		rule.Action = RewriteSet
+		if len(args) != 1 {
+			return nil, ErrInvalidRewriteRule
+		}
+		if rule.Addr, err = netip.ParseAddrPort(args[0]); err != nil {
+			addr, err := netip.ParseAddr(args[0])
+			if err != nil {
+				return nil, ErrInvalidRewriteRule
+			}
+			rule.Addr = netip.AddrPortFrom(addr, 0)
+		}
+	default:
+		return nil, ErrInvalidRewriteRule
+	}
+
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// Apply returns a copy of header with its addresses rewritten, ready to be
+// formatted again; TLVs are kept. The header keeps its family unless a rule
+// moves an address to the other one, then it is IPv4 when both addresses are,
+// otherwise the IPv4 one is written as an IPv4-mapped IPv6 address. Headers
+// without IP addresses are returned as they are.
+func (rules RewriteRules) Apply(header *Header) (*Header, error) {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	src, srcOK := header.SourceAddrPort()
+	dst, dstOK := header.DestinationAddrPort()
+	if header.Command.IsLocal() || !srcOK || !dstOK {
+		return header, nil
+	}
+	origSrc, origDst := src, dst
+	for _, rule := range rules {
+		if rule.Field == RewriteSource {
+			src = rule.apply(src)
+		} else {
+			dst = rule.apply(dst)
+		}
+	}
+
+	v4 := header.TransportProtocol.IsIPv4()
+	moved := func(orig, addr netip.AddrPort) bool {
+		return addr != orig && addr.Addr().Unmap().Is4() != v4
+	}
+	if moved(origSrc, src) || moved(origDst, dst) {
+		v4 = src.Addr().Unmap().Is4() && dst.Addr().Unmap().Is4()
+	}
+
+	rewritten := *header
+	rewritten.raw = nil
+	if v4 {
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	} else {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	if header.TransportProtocol.IsDatagram() {
+		rewritten.TransportProtocol = UDPv6
+		if v4 {
+			rewritten.TransportProtocol = UDPv4
+		}
+		rewritten.SourceAddr = net.UDPAddrFromAddrPort(src)
+		rewritten.DestinationAddr = net.UDPAddrFromAddrPort(dst)
+	} else {
+		rewritten.TransportProtocol = TCPv6
+		if v4 {
+			rewritten.TransportProtocol = TCPv4
+		}
+		rewritten.SourceAddr = net.TCPAddrFromAddrPort(src)
+		rewritten.DestinationAddr = net.TCPAddrFromAddrPort(dst)
+	}
+	return &rewritten, nil
+}
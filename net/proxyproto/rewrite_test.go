@@ -0,0 +1,155 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    string
+		header   string
+		family   AddressFamilyAndProtocol
+		src, dst string
+	}{
+		{"mask v4", "src mask 24", "PROXY TCP4 10.1.1.77 20.2.2.2 1000 2000\r\n", TCPv4, "10.1.1.0:1000", "20.2.2.2:2000"},
+		{"mask v6", "src mask 24 64", "PROXY TCP6 2001:db8:1:2:3::4 2001:db8::2 1000 2000\r\n", TCPv6, "[2001:db8:1:2::]:1000", "[2001:db8::2]:2000"},
+		{"mask skips family", "src mask 0 64", "PROXY TCP4 10.1.1.77 20.2.2.2 1000 2000\r\n", TCPv4, "10.1.1.77:1000", "20.2.2.2:2000"},
+		{"mapped v4", "src mask 24", "PROXY TCP6 ::ffff:10.1.1.77 ::ffff:20.2.2.2 1000 2000\r\n", TCPv4, "10.1.1.0:1000", "20.2.2.2:2000"},
+		// Mapped addresses print as IPv4 too, the family shows they stay mapped.
+		{"mapped unmatched", "dst set 10.0.0.10:443 if 30.0.0.0/8", "PROXY TCP6 ::ffff:10.1.1.77 ::ffff:20.2.2.2 1000 2000\r\n", TCPv6, "10.1.1.77:1000", "20.2.2.2:2000"},
+		{"mapped set v6", "dst set [2001:db8::10]:443", "PROXY TCP6 ::ffff:10.1.1.77 ::ffff:20.2.2.2 1000 2000\r\n", TCPv6, "10.1.1.77:1000", "[2001:db8::10]:443"},
+		{"nat64", "src nat64 64:ff9b::/96\ndst nat64 64:ff9b::/96", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", TCPv6, "[64:ff9b::a01:101]:1000", "[64:ff9b::1402:202]:2000"},
+		{"nat46", "src nat46 64:ff9b::/96\ndst nat46 64:ff9b::/96", "PROXY TCP6 64:ff9b::a01:101 64:ff9b::1402:202 1000 2000\r\n", TCPv4, "10.1.1.1:1000", "20.2.2.2:2000"},
+		// The destination is sent as ::ffff:20.2.2.2, which net.IP prints as IPv4.
+		{"mixed families", "src nat64 64:ff9b::/96", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", TCPv6, "[64:ff9b::a01:101]:1000", "20.2.2.2:2000"},
+		{"set destination", "dst set 10.0.0.10:443 if 20.2.2.0/24", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", TCPv4, "10.1.1.1:1000", "10.0.0.10:443"},
+		{"set keeps port", "dst set 10.0.0.10", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", TCPv4, "10.1.1.1:1000", "10.0.0.10:2000"},
+		{"if not matched", "dst set 10.0.0.10:443 if 30.0.0.0/8", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", TCPv4, "10.1.1.1:1000", "20.2.2.2:2000"},
+		{"in order", "src mask 16\nsrc set 1.1.1.1 if 10.1.0.0/16", "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n", TCPv4, "1.1.1.1:1000", "20.2.2.2:2000"},
+	}
+
+	for _, tt := range tests {
+		rules, err := ParseRewriteRules(strings.NewReader(tt.rules))
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		header, err := Read(bufio.NewReader(strings.NewReader(tt.header)))
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		original := header.SourceAddr.String() + " " + header.DestinationAddr.String()
+		rewritten, err := rules.Apply(header)
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if header.SourceAddr.String()+" "+header.DestinationAddr.String() != original {
+			t.Fatalf("%s: input header modified", tt.name)
+		}
+
+		// Check the re-encoded header, in both versions.
+		for _, version := range []byte{1, 2} {
+			rewritten.Version = version
+			raw, err := rewritten.Format()
+			if err != nil {
+				t.Fatalf("%s: v%d: err: %v", tt.name, version, err)
+			}
+			parsed, err := Read(bufio.NewReader(bytes.NewReader(raw)))
+			if err != nil {
+				t.Fatalf("%s: v%d: err: %v", tt.name, version, err)
+			}
+			if parsed.TransportProtocol != tt.family || parsed.SourceAddr.String() != tt.src || parsed.DestinationAddr.String() != tt.dst {
+				t.Fatalf("%s: v%d: bad: %v %v %v", tt.name, version, parsed.TransportProtocol, parsed.SourceAddr, parsed.DestinationAddr)
+			}
+		}
+	}
+}
+
+func TestRewriteKeepsTLVsAndUDP(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("10.1.1.77"), Port: 1000}
+	dst := &net.UDPAddr{IP: net.ParseIP("20.2.2.2"), Port: 53}
+	header := HeaderFromAddrs(2, src, dst)
+	tlvs := []TLV{{PP2_TYPE_AUTHORITY, []byte("example.com")}, {PP2_TYPE_UNIQUE_ID, []byte("42")}}
+	header.SetTLVs(tlvs)
+
+	rules, _ := ParseRewriteRules(strings.NewReader("src mask 24\nsrc nat64 64:ff9b::/96"))
+	rewritten, err := rules.Apply(header)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw, err := rewritten.Format()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	parsed, err := Read(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if parsed.TransportProtocol != UDPv6 || parsed.SourceAddr.String() != "[64:ff9b::a01:100]:1000" {
+		t.Fatalf("bad: %v %v", parsed.TransportProtocol, parsed.SourceAddr)
+	}
+	got, _ := parsed.TLVs()
+	if len(got) != 2 || string(got[0].Value) != "example.com" || string(got[1].Value) != "42" {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+func TestRewriteLocalAndUnix(t *testing.T) {
+	rules, _ := ParseRewriteRules(strings.NewReader("src set 1.1.1.1"))
+	for _, header := range []*Header{
+		{Version: 2, Command: LOCAL, TransportProtocol: UNSPEC},
+		HeaderFromAddrs(2, &net.UnixAddr{Net: "unix", Name: "/a"}, &net.UnixAddr{Net: "unix", Name: "/b"}),
+	} {
+		rewritten, err := rules.Apply(header)
+		if err != nil || rewritten != header {
+			t.Fatalf("bad: %+v %v", rewritten, err)
+		}
+	}
+}
+
+func TestParseRewriteRulesErrors(t *testing.T) {
+	for _, line := range []string{
+		"src", "both mask 24", "src mask 33", "src mask x", "src mask 24 64 1",
+		"src nat64 64:ff9b::/64", "src nat64 10.0.0.0/8", "dst set nowhere",
+		"src drop 1.1.1.1", "dst set 1.1.1.1 if 1.1.1",
+	} {
+		if _, err := ParseRewriteRules(strings.NewReader(line)); !errors.Is(err, ErrInvalidRewriteRule) {
+			t.Fatalf("%q: expected invalid rule, got: %v", line, err)
+		}
+	}
+}
+
+func TestRelayRewrite(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: backend}
+	defer pl.Close()
+	rules, _ := ParseRewriteRules(strings.NewReader("src mask 24\ndst set 10.0.0.10:443"))
+	relay := startRelay(t, &Relay{Target: backend.Addr().String(), Rewrite: rules})
+
+	client, err := net.Dial("tcp", relay.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 10.1.1.77 20.2.2.2 1000 2000\r\nping"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	io.ReadFull(conn, make([]byte, 4))
+	header := conn.(*Conn).ProxyHeader()
+	if header.Version != 1 || header.SourceAddr.String() != "10.1.1.0:1000" || header.DestinationAddr.String() != "10.0.0.10:443" {
+		t.Fatalf("bad: %+v", header)
+	}
+}
@@ -0,0 +1,242 @@
+package proxyproto
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRouterClosed = errors.New("proxyproto: router closed")
+)
+
+// PortRange is an inclusive range of ports, the zero value matches every port.
+type PortRange struct {
+	First, Last uint16
+}
+
+// Port returns the range holding only port.
+func Port(port uint16) PortRange {
+	return PortRange{First: port, Last: port}
+}
+
+// Contains reports whether port is in the range.
+func (r PortRange) Contains(port uint16) bool {
+	if r == (PortRange{}) {
+		return true
+	}
+	return r.First <= port && port <= r.Last
+}
+
+// Router dispatches connections to child listeners by their destination address,
+// which is the one of the PROXY header when there is one and the socket's
+// otherwise. Routes are tried in registration order and the first one holding
+// the destination wins; connections no route holds go to the default route, or
+// are closed when there is none.
+//
+// Each route applies its own Policy to the header:
+//   - USE delivers connections with or without a header.
+//   - REQUIRE closes connections without a header.
+//   - REJECT closes connections with a header.
+//   - SKIP delivers connections reporting their socket addresses, the header is
+//     consumed but ignored.
+type Router struct {
+	// ReadHeaderTimeout bounds how long reading the header of connections wrapped
+	// by the Router may take, DefaultReadHeaderTimeout if unset.
+	ReadHeaderTimeout time.Duration
+
+	root net.Listener
+
+	mu     sync.Mutex
+	routes []*route
+	def    *route
+	donec  chan struct{}
+	closed bool
+}
+
+type route struct {
+	prefix   netip.Prefix
+	ports    PortRange
+	policy   Policy
+	listener *muxListener
+}
+
+// NewRouter returns a Router accepting connections from l. Connections not
+// already read through a PROXY Listener are wrapped with NewConn.
+func NewRouter(l net.Listener) *Router {
+	return &Router{
+		root:  l,
+		donec: make(chan struct{}),
+	}
+}
+
+// Route returns a child listener receiving the connections whose destination is
+// within prefix and ports. The zero prefix matches every address.
+func (r *Router) Route(prefix netip.Prefix, ports PortRange, policy Policy) net.Listener {
+	rt := r.newRoute(prefix.Masked(), ports, policy)
+	r.mu.Lock()
+	r.routes = append(r.routes, rt)
+	r.mu.Unlock()
+	return rt.listener
+}
+
+// Default returns the child listener receiving the connections no route holds.
+// Calling it again replaces the previous default route.
+func (r *Router) Default(policy Policy) net.Listener {
+	rt := r.newRoute(netip.Prefix{}, PortRange{}, policy)
+	r.mu.Lock()
+	r.def = rt
+	r.mu.Unlock()
+	return rt.listener
+}
+
+// Handle routes the connections of Route(prefix, ports, policy) to handler, each
+// in its own goroutine.
+func (r *Router) Handle(prefix netip.Prefix, ports PortRange, policy Policy, handler func(net.Conn)) {
+	go serveHandler(r.Route(prefix, ports, policy), handler)
+}
+
+// HandleDefault routes the connections of Default(policy) to handler, each in its
+// own goroutine.
+func (r *Router) HandleDefault(policy Policy, handler func(net.Conn)) {
+	go serveHandler(r.Default(policy), handler)
+}
+
+func serveHandler(l net.Listener, handler func(net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handler(conn)
+	}
+}
+
+func (r *Router) newRoute(prefix netip.Prefix, ports PortRange, policy Policy) *route {
+	return &route{
+		prefix: prefix,
+		ports:  ports,
+		policy: policy,
+		listener: &muxListener{
+			addr:  r.root.Addr(),
+			connc: make(chan net.Conn),
+			donec: make(chan struct{}),
+		},
+	}
+}
+
+// Serve accepts connections until the root listener fails or the Router is closed.
+func (r *Router) Serve() error {
+	for {
+		conn, err := r.root.Accept()
+		if err != nil {
+			select {
+			case <-r.donec:
+				return ErrRouterClosed
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go r.dispatch(conn)
+	}
+}
+
+// Close closes the root listener and every child listener.
+func (r *Router) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.donec)
+	routes := r.routes
+	if r.def != nil {
+		routes = append(routes[:len(routes):len(routes)], r.def)
+	}
+	r.mu.Unlock()
+
+	for _, rt := range routes {
+		rt.listener.Close()
+	}
+	return r.root.Close()
+}
+
+func (r *Router) dispatch(conn net.Conn) {
+	proxyConn, ok := conn.(*Conn)
+	if !ok {
+		proxyConn = NewConn(conn)
+		proxyConn.readHeaderTimeout = r.ReadHeaderTimeout
+		if proxyConn.readHeaderTimeout <= 0 {
+			proxyConn.readHeaderTimeout = DefaultReadHeaderTimeout
+		}
+	}
+
+	header := proxyConn.ProxyHeader()
+	if header == nil && proxyConn.readErr != ErrNoProxyProtocol {
+		proxyConn.Close()
+		return
+	}
+
+	rt := r.match(proxyConn)
+	if rt == nil {
+		proxyConn.Close()
+		return
+	}
+
+	var routed net.Conn = proxyConn
+	switch rt.policy {
+	case REQUIRE:
+		if header == nil {
+			proxyConn.Close()
+			return
+		}
+	case REJECT:
+		if header != nil {
+			proxyConn.Close()
+			return
+		}
+	case SKIP:
+		routed = &skipConn{proxyConn}
+	}
+
+	if !rt.listener.deliver(routed) {
+		proxyConn.Close()
+	}
+}
+
+// match returns the route holding the destination of conn, nil when there is none.
+func (r *Router) match(conn *Conn) *route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dst, ok := conn.LocalAddrPort()
+	if ok {
+		addr := dst.Addr().Unmap().WithZone("")
+		for _, rt := range r.routes {
+			if (!rt.prefix.IsValid() || rt.prefix.Contains(addr)) && rt.ports.Contains(dst.Port()) {
+				return rt
+			}
+		}
+	}
+	return r.def
+}
+
+// skipConn reports the socket addresses of a connection whose header is ignored.
+type skipConn struct {
+	*Conn
+}
+
+func (c *skipConn) LocalAddr() net.Addr {
+	return c.Conn.Conn.LocalAddr()
+}
+
+func (c *skipConn) RemoteAddr() net.Addr {
+	return c.Conn.Conn.RemoteAddr()
+}
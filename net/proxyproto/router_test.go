@@ -0,0 +1,111 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router := NewRouter(&Listener{Listener: l})
+	vip1 := router.Route(netip.MustParsePrefix("20.2.2.0/24"), PortRange{}, USE)
+	vip2 := router.Route(netip.MustParsePrefix("30.3.3.3/32"), PortRange{First: 443, Last: 444}, REQUIRE)
+	skipped := router.Route(netip.MustParsePrefix("40.4.4.4/32"), Port(80), SKIP)
+	def := router.Default(REJECT)
+	go router.Serve()
+	defer router.Close()
+
+	dial := func(header string) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte(header + "ping"))
+		return conn
+	}
+	accept := func(l net.Listener) net.Conn {
+		connc := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				connc <- conn
+			}
+		}()
+		select {
+		case conn := <-connc:
+			return conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out accepting")
+			return nil
+		}
+	}
+
+	dial("PROXY TCP4 10.1.1.1 20.2.2.9 1000 8080\r\n")
+	if conn := accept(vip1); conn.LocalAddr().String() != "20.2.2.9:8080" {
+		t.Fatalf("bad: %v", conn.LocalAddr())
+	}
+
+	dial("PROXY TCP6 ::1 ::ffff:30.3.3.3 1000 444\r\n")
+	if conn := accept(vip2); conn.RemoteAddr().String() != "[::1]:1000" {
+		t.Fatalf("bad: %v", conn.RemoteAddr())
+	}
+
+	dial("PROXY TCP4 10.1.1.1 40.4.4.4 1000 80\r\n")
+	conn := accept(skipped)
+	if conn.RemoteAddr().String() == "10.1.1.1:1000" {
+		t.Fatalf("header not skipped: %v", conn.RemoteAddr())
+	}
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil || string(recv) != "ping" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+
+	// No route holds 30.3.3.3:80, and the default route rejects headers.
+	rejected := dial("PROXY TCP4 10.1.1.1 30.3.3.3 1000 80\r\n")
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+
+	// Without a header, the socket destination 127.0.0.1 goes to the default route.
+	dial("")
+	if conn := accept(def); conn.LocalAddr().String() != l.Addr().String() {
+		t.Fatalf("bad: %v", conn.LocalAddr())
+	}
+}
+
+func TestRouterReadHeaderTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router := NewRouter(l)
+	router.ReadHeaderTimeout = 100 * time.Millisecond
+	router.Default(USE)
+	go router.Serve()
+	defer router.Close()
+
+	// A client which sends nothing is dropped instead of holding its dispatch.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got: %v", err)
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	if !(PortRange{}).Contains(1) || !Port(80).Contains(80) || Port(80).Contains(81) {
+		t.Fatal("bad port range")
+	}
+}
@@ -0,0 +1,273 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotTLS               = errors.New("proxyproto: connection doesn't start with a TLS handshake")
+	ErrInvalidClientHello   = errors.New("proxyproto: invalid TLS ClientHello")
+	ErrNoRouteForServerName = errors.New("proxyproto: no route for server name")
+)
+
+const (
+	tlsRecordHeaderLen    = 5
+	maxTLSRecordLen       = 16384
+	tlsHandshakeType      = '\x16'
+	tlsClientHelloType    = '\x01'
+	tlsExtServerName      = 0
+	tlsExtALPN            = 16
+	tlsServerNameHostName = 0
+)
+
+// ClientHello holds the parts of a TLS ClientHello routing is based on.
+type ClientHello struct {
+	ServerName string
+	ALPN       []string
+}
+
+// PeekClientHello parses the TLS ClientHello at the start of the reader without
+// consuming it. The reader must be able to buffer a full TLS record, see
+// NewClientHelloReader. ClientHellos spanning several records aren't supported.
+func PeekClientHello(reader *bufio.Reader) (*ClientHello, error) {
+	b, err := reader.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != tlsHandshakeType || b[1] != 3 {
+		return nil, ErrNotTLS
+	}
+	length := int(b[3])<<8 | int(b[4])
+	if length > maxTLSRecordLen {
+		return nil, ErrInvalidClientHello
+	}
+	record, err := reader.Peek(tlsRecordHeaderLen + length)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientHello(record[tlsRecordHeaderLen:])
+}
+
+// NewClientHelloReader returns a reader large enough for PeekClientHello.
+func NewClientHelloReader(conn net.Conn) *bufio.Reader {
+	return bufio.NewReaderSize(conn, tlsRecordHeaderLen+maxTLSRecordLen)
+}
+
+// tlsReader reads the length-prefixed fields of a handshake message.
+type tlsReader []byte
+
+func (r *tlsReader) bytes(n int) ([]byte, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+func (r *tlsReader) uint(n int) (int, bool) {
+	b, ok := r.bytes(n)
+	if !ok {
+		return 0, false
+	}
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v, true
+}
+
+// prefixed returns the field prefixed by an n-byte length.
+func (r *tlsReader) prefixed(n int) (tlsReader, bool) {
+	length, ok := r.uint(n)
+	if !ok {
+		return nil, false
+	}
+	b, ok := r.bytes(length)
+	return tlsReader(b), ok
+}
+
+func parseClientHello(msg []byte) (*ClientHello, error) {
+	r := tlsReader(msg)
+	if t, ok := r.uint(1); !ok || t != tlsClientHelloType {
+		return nil, ErrInvalidClientHello
+	}
+	body, ok := r.prefixed(3)
+	if !ok {
+		return nil, ErrInvalidClientHello
+	}
+
+	// Version and random, then session ID, cipher suites and compression methods.
+	if _, ok := body.bytes(2 + 32); !ok {
+		return nil, ErrInvalidClientHello
+	}
+	for _, n := range []int{1, 2, 1} {
+		if _, ok := body.prefixed(n); !ok {
+			return nil, ErrInvalidClientHello
+		}
+	}
+
+	hello := &ClientHello{}
+	if len(body) == 0 {
+		return hello, nil
+	}
+	extensions, ok := body.prefixed(2)
+	if !ok {
+		return nil, ErrInvalidClientHello
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.uint(2)
+		if !ok {
+			return nil, ErrInvalidClientHello
+		}
+		data, ok := extensions.prefixed(2)
+		if !ok {
+			return nil, ErrInvalidClientHello
+		}
+
+		switch extType {
+		case tlsExtServerName:
+			names, ok := data.prefixed(2)
+			if !ok {
+				return nil, ErrInvalidClientHello
+			}
+			for len(names) > 0 {
+				nameType, ok := names.uint(1)
+				if !ok {
+					return nil, ErrInvalidClientHello
+				}
+				name, ok := names.prefixed(2)
+				if !ok {
+					return nil, ErrInvalidClientHello
+				}
+				if nameType == tlsServerNameHostName && hello.ServerName == "" {
+					hello.ServerName = string(name)
+				}
+			}
+		case tlsExtALPN:
+			protocols, ok := data.prefixed(2)
+			if !ok {
+				return nil, ErrInvalidClientHello
+			}
+			for len(protocols) > 0 {
+				protocol, ok := protocols.prefixed(1)
+				if !ok || len(protocol) == 0 {
+					return nil, ErrInvalidClientHello
+				}
+				hello.ALPN = append(hello.ALPN, string(protocol))
+			}
+		}
+	}
+	return hello, nil
+}
+
+// SNIRouter forwards TLS connections, still encrypted, to the backend routed for
+// the server name of their ClientHello. Each backend first receives a v2 PROXY
+// header carrying the server name as PP2_TYPE_AUTHORITY and one PP2_TYPE_ALPN
+// TLV per protocol the client offered.
+type SNIRouter struct {
+	// Routes maps server names to backend addresses. A name such as
+	// "*.example.com" matches one label in place of the star. Names are matched
+	// without regard to case.
+	Routes map[string]string
+	// Default is the backend of connections whose server name has no route, or
+	// which have none. Empty means they are closed.
+	Default string
+
+	// ReadTimeout bounds how long reading the ClientHello may take, zero means no limit.
+	ReadTimeout time.Duration
+	// DialTimeout bounds connecting to a backend, zero means no limit.
+	DialTimeout time.Duration
+}
+
+// Serve forwards every connection accepted from l until it fails.
+func (r *SNIRouter) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := r.ServeConn(conn); err != nil {
+				log.Printf("sni %s %s: %v", connID(conn), conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn forwards a single connection and closes it when either side is done.
+func (r *SNIRouter) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := headerError(conn); err != nil {
+		return err
+	}
+
+	reader := NewClientHelloReader(conn)
+	if r.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(r.ReadTimeout))
+	}
+	hello, err := PeekClientHello(reader)
+	if err != nil {
+		return err
+	}
+	if r.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	target, ok := r.route(hello.ServerName)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrNoRouteForServerName, hello.ServerName)
+	}
+
+	var tlvs []TLV
+	if hello.ServerName != "" {
+		tlvs = append(tlvs, TLV{Type: PP2_TYPE_AUTHORITY, Value: []byte(hello.ServerName)})
+	}
+	// The spec defines PP2_TYPE_ALPN as a single protocol. The handshake isn't
+	// terminated here so none is negotiated yet, and every offered one gets a
+	// TLV of its own instead, TLSListener accepts any of them.
+	for _, protocol := range hello.ALPN {
+		tlvs = append(tlvs, TLV{Type: PP2_TYPE_ALPN, Value: []byte(protocol)})
+	}
+	header, err := backendHeader(2, conn, tlvs...)
+	if err != nil {
+		return err
+	}
+
+	backend, err := net.DialTimeout("tcp", target, r.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	if _, err := backend.Write(header); err != nil {
+		return err
+	}
+	return pipe(&muxConn{socketConn: socketConn{conn}, reader: reader}, backend)
+}
+
+// route returns the backend of serverName, exact names win over wildcards.
+func (r *SNIRouter) route(serverName string) (string, bool) {
+	name := strings.TrimSuffix(serverName, ".")
+	if name != "" {
+		candidates := []string{name}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			candidates = append(candidates, "*"+name[i:])
+		}
+		for _, candidate := range candidates {
+			for pattern, target := range r.Routes {
+				if strings.EqualFold(pattern, candidate) {
+					return target, true
+				}
+			}
+		}
+	}
+	return r.Default, r.Default != ""
+}
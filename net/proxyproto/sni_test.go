@@ -0,0 +1,209 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the first flight of a TLS client.
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, config).Handshake()
+	}()
+	defer client.Close()
+	defer server.Close()
+
+	reader := NewClientHelloReader(server)
+	if _, err := PeekClientHello(reader); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	b, _ := reader.Peek(reader.Buffered())
+	return append([]byte(nil), b...)
+}
+
+func TestPeekClientHello(t *testing.T) {
+	raw := captureClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	reader := bufio.NewReaderSize(bytes.NewReader(raw), len(raw))
+	hello, err := PeekClientHello(reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if hello.ServerName != "example.com" || len(hello.ALPN) != 2 || hello.ALPN[0] != "h2" || hello.ALPN[1] != "http/1.1" {
+		t.Fatalf("bad: %+v", hello)
+	}
+	// Nothing was consumed.
+	if reader.Buffered() != len(raw) {
+		t.Fatalf("bad: %d", reader.Buffered())
+	}
+
+	if _, err := PeekClientHello(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))); err != ErrNotTLS {
+		t.Fatalf("expected ErrNotTLS, got: %v", err)
+	}
+	// A record truncated after its header fails like a short read.
+	if _, err := PeekClientHello(bufio.NewReaderSize(bytes.NewReader(raw[:20]), len(raw))); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+	// A record whose content is cut short is invalid.
+	corrupt := append([]byte(nil), raw...)
+	corrupt[8] = 0xff
+	if _, err := PeekClientHello(bufio.NewReaderSize(bytes.NewReader(corrupt), len(raw))); err != ErrInvalidClientHello {
+		t.Fatalf("expected ErrInvalidClientHello, got: %v", err)
+	}
+}
+
+func TestSNIRouter(t *testing.T) {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "example.com", "api.example.com")},
+		NextProtos:   []string{"h2"},
+	}
+	startTLSBackend := func() *TLSListener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tl := NewTLSListener(l, config)
+		tl.AuthorityCheck = CheckRequired
+		tl.ALPNCheck = CheckRequired
+		t.Cleanup(func() { tl.Close() })
+		return tl
+	}
+	api := startTLSBackend()
+	def := startTLSBackend()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router := &SNIRouter{
+		Routes:      map[string]string{"*.EXAMPLE.com": api.Addr().String()},
+		Default:     def.Addr().String(),
+		ReadTimeout: 5 * time.Second,
+	}
+	go router.Serve(l)
+	defer l.Close()
+
+	for _, tt := range []struct {
+		serverName string
+		backend    net.Listener
+	}{
+		{"api.example.com", api},
+		{"example.com", def},
+	} {
+		go func(serverName string) {
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+				ServerName:         serverName,
+				NextProtos:         []string{"h2"},
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			io.ReadAll(conn)
+		}(tt.serverName)
+
+		conn, err := tt.backend.Accept()
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.serverName, err)
+		}
+		recv := make([]byte, 4)
+		if _, err := io.ReadFull(conn, recv); err != nil || string(recv) != "ping" {
+			t.Fatalf("%s: bad: %q %v", tt.serverName, recv, err)
+		}
+		state := conn.(*tls.Conn).ConnectionState()
+		if state.ServerName != tt.serverName || state.NegotiatedProtocol != "h2" {
+			t.Fatalf("%s: bad: %+v", tt.serverName, state)
+		}
+		if conn.RemoteAddr().String() == l.Addr().String() {
+			t.Fatalf("%s: client address not forwarded: %v", tt.serverName, conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
+
+func TestSNIRouterForwardsTLVs(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	_, backend := startBackend(t, 2)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+	router := &SNIRouter{Default: backend.Addr().String(), ReadTimeout: 5 * time.Second}
+	go router.Serve(pl)
+
+	client, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+	client.Write(testV2Header(src, dst,
+		TLV{PP2_TYPE_AUTHORITY, []byte("upstream.example.com")},
+		TLV{PP2_TYPE_UNIQUE_ID, []byte("upstream-id")}))
+	client.Write(hello)
+
+	accepted, err := backend.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer accepted.Close()
+	conn := accepted.(*Conn)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	recv := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, recv); err != nil || !bytes.Equal(recv, hello) {
+		t.Fatalf("bad: %d bytes %v", len(recv), err)
+	}
+
+	if conn.RemoteAddr().String() != src.String() {
+		t.Fatalf("bad remote: %v", conn.RemoteAddr())
+	}
+	if conn.ID() != "upstream-id" {
+		t.Fatalf("bad id: %q", conn.ID())
+	}
+	tlvs, err := conn.ProxyHeader().TLVs()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var authority []string
+	var alpn []string
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case PP2_TYPE_AUTHORITY:
+			authority = append(authority, string(tlv.Value))
+		case PP2_TYPE_ALPN:
+			alpn = append(alpn, string(tlv.Value))
+		}
+	}
+	if len(authority) != 1 || authority[0] != "example.com" {
+		t.Fatalf("bad authority: %q", authority)
+	}
+	if len(alpn) != 2 || alpn[0] != "h2" || alpn[1] != "http/1.1" {
+		t.Fatalf("bad alpn: %q", alpn)
+	}
+
+	// Half-closes pass through in either direction.
+	conn.Write([]byte("pong"))
+	conn.Conn.(*net.TCPConn).CloseWrite()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if recv, err := io.ReadAll(client); err != nil || string(recv) != "pong" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+	client.Write([]byte("ping"))
+	client.(*net.TCPConn).CloseWrite()
+	if recv, err := io.ReadAll(conn); err != nil || string(recv) != "ping" {
+		t.Fatalf("bad: %q %v", recv, err)
+	}
+}
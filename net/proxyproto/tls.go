@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrAuthorityMismatch = errors.New("proxyproto: TLS server name doesn't match PP2_TYPE_AUTHORITY")
+	ErrALPNMismatch      = errors.New("proxyproto: TLS negotiated protocol doesn't match PP2_TYPE_ALPN")
+	ErrMissingAuthority  = errors.New("proxyproto: PROXY header has no PP2_TYPE_AUTHORITY")
+	ErrMissingALPN       = errors.New("proxyproto: PROXY header has no PP2_TYPE_ALPN")
+)
+
+// TLVCheck controls how TLSListener compares a TLV with the TLS handshake.
+type TLVCheck int
+
+const (
+	// CheckIfPresent rejects the handshake when the TLV is present and disagrees with it.
+	CheckIfPresent TLVCheck = iota
+	// CheckRequired also rejects the handshake when the TLV is absent.
+	CheckRequired
+	// CheckIgnore never looks at the TLV.
+	CheckIgnore
+)
+
+// TLSListener terminates TLS on connections that start with a PROXY header, in
+// that order. The handshake runs on first use of the connection, like
+// tls.NewListener, and fails when the negotiated server name or protocol
+// disagrees with the PP2_TYPE_AUTHORITY or PP2_TYPE_ALPN TLVs.
+type TLSListener struct {
+	Listener *Listener
+	Config   *tls.Config
+
+	AuthorityCheck TLVCheck
+	ALPNCheck      TLVCheck
+}
+
+// NewTLSListener returns a TLSListener reading PROXY headers from inner and
+// checking both TLVs when they are present.
+func NewTLSListener(inner net.Listener, config *tls.Config) *TLSListener {
+	return &TLSListener{
+		Listener: &Listener{Listener: inner},
+		Config:   config,
+	}
+}
+
+func (l *TLSListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyConn, ok := conn.(*Conn)
+	if !ok {
+		return tls.Server(conn, l.Config), nil
+	}
+
+	config := l.Config.Clone()
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := l.verify(proxyConn.header, state); err != nil {
+			return err
+		}
+		if verify != nil {
+			return verify(state)
+		}
+		return nil
+	}
+	return tls.Server(proxyConn, config), nil
+}
+
+func (l *TLSListener) Close() error {
+	return l.Listener.Close()
+}
+
+func (l *TLSListener) Addr() net.Addr {
+	return l.Listener.Addr()
+}
+
+func (l *TLSListener) verify(header *Header, state tls.ConnectionState) error {
+	var authority []byte
+	var alpn [][]byte
+	if header != nil {
+		tlvs, err := header.TLVs()
+		if err != nil {
+			return err
+		}
+		for _, tlv := range tlvs {
+			switch tlv.Type {
+			case PP2_TYPE_AUTHORITY:
+				authority = tlv.Value
+			case PP2_TYPE_ALPN:
+				alpn = append(alpn, tlv.Value)
+			}
+		}
+	}
+
+	switch {
+	case l.AuthorityCheck == CheckIgnore:
+	case authority == nil && l.AuthorityCheck == CheckRequired:
+		return ErrMissingAuthority
+	case authority != nil && !strings.EqualFold(string(authority), state.ServerName):
+		return ErrAuthorityMismatch
+	}
+
+	switch {
+	case l.ALPNCheck == CheckIgnore:
+	case alpn == nil && l.ALPNCheck == CheckRequired:
+		return ErrMissingALPN
+	case alpn != nil:
+		// A proxy may report the single negotiated protocol or, like SNIRouter
+		// which doesn't terminate TLS, one TLV per offered protocol. A handshake
+		// which negotiated none matches neither.
+		for _, proto := range alpn {
+			if string(proto) == state.NegotiatedProtocol {
+				return nil
+			}
+		}
+		return ErrALPNMismatch
+	}
+
+	return nil
+}
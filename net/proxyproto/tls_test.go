@@ -0,0 +1,183 @@
+package proxyproto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// testV2Header builds a v2 PROXY TCPv4 header carrying the given TLVs.
+func testV2Header(src, dst *net.TCPAddr, tlvs ...TLV) []byte {
+	var payload []byte
+	payload = append(payload, src.IP.To4()...)
+	payload = append(payload, dst.IP.To4()...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(src.Port))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		payload = append(payload, byte(tlv.Type))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+
+	header := append([]byte{}, SIGV2...)
+	header = append(header, byte(PROXY), byte(TCPv4))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestTLSListener(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+
+	tests := []struct {
+		name       string
+		serverName string
+		tlvs       []TLV
+		check      TLVCheck
+		ok         bool
+	}{
+		{"no tlvs", "example.com", nil, CheckIfPresent, true},
+		{"matching", "example.com", []TLV{{PP2_TYPE_AUTHORITY, []byte("Example.com")}, {PP2_TYPE_ALPN, []byte("h2")}}, CheckIfPresent, true},
+		{"authority mismatch", "example.com", []TLV{{PP2_TYPE_AUTHORITY, []byte("other.com")}}, CheckIfPresent, false},
+		{"alpn mismatch", "example.com", []TLV{{PP2_TYPE_ALPN, []byte("http/1.1")}}, CheckIfPresent, false},
+		{"mismatch ignored", "example.com", []TLV{{PP2_TYPE_AUTHORITY, []byte("other.com")}}, CheckIgnore, true},
+		{"missing required", "example.com", nil, CheckRequired, false},
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "example.com")},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	for _, tt := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tlsL := NewTLSListener(l, config)
+		tlsL.AuthorityCheck = tt.check
+		tlsL.ALPNCheck = tt.check
+
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write(testV2Header(src, dst, tt.tlvs...))
+			client := tls.Client(conn, &tls.Config{
+				ServerName:         tt.serverName,
+				NextProtos:         []string{"h2"},
+				InsecureSkipVerify: true,
+			})
+			if client.Handshake() == nil {
+				client.Write([]byte("ping"))
+			}
+		}()
+
+		conn, err := tlsL.Accept()
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		err = conn.(*tls.Conn).Handshake()
+		if tt.ok && err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Fatalf("%s: expected handshake to fail", tt.name)
+		}
+		if tt.ok && conn.RemoteAddr().String() != src.String() {
+			t.Fatalf("%s: bad remote address: %v", tt.name, conn.RemoteAddr())
+		}
+		conn.Close()
+		tlsL.Close()
+	}
+}
+
+func TestTLSListenerNoNegotiatedProtocol(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	dst := &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000}
+
+	tests := []struct {
+		name  string
+		tlvs  []TLV
+		check TLVCheck
+		ok    bool
+	}{
+		{"claimed if present", []TLV{{PP2_TYPE_ALPN, []byte("h2")}}, CheckIfPresent, false},
+		{"claimed required", []TLV{{PP2_TYPE_ALPN, []byte("h2")}}, CheckRequired, false},
+		{"claimed ignored", []TLV{{PP2_TYPE_ALPN, []byte("h2")}}, CheckIgnore, true},
+		{"not claimed", nil, CheckIfPresent, true},
+	}
+
+	// No NextProtos: the server negotiates nothing whatever the client offers.
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "example.com")}}
+
+	for _, tt := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tlsL := NewTLSListener(l, config)
+		tlsL.ALPNCheck = tt.check
+
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write(testV2Header(src, dst, tt.tlvs...))
+			client := tls.Client(conn, &tls.Config{
+				ServerName:         "example.com",
+				NextProtos:         []string{"h2"},
+				InsecureSkipVerify: true,
+			})
+			if client.Handshake() == nil {
+				client.Write([]byte("ping"))
+			}
+		}()
+
+		conn, err := tlsL.Accept()
+		if err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		err = conn.(*tls.Conn).Handshake()
+		if tt.ok && err != nil {
+			t.Fatalf("%s: err: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrALPNMismatch) {
+			t.Fatalf("%s: expected ErrALPNMismatch, got: %v", tt.name, err)
+		}
+		conn.Close()
+		tlsL.Close()
+	}
+}
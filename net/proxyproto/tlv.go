@@ -0,0 +1,104 @@
+package proxyproto
+
+import (
+	"errors"
+)
+
+// PP2Type is the type of a v2 Type-Length-Value vector.
+type PP2Type byte
+
+const (
+	PP2_TYPE_ALPN           PP2Type = '\x01'
+	PP2_TYPE_AUTHORITY      PP2Type = '\x02'
+	PP2_TYPE_CRC32C         PP2Type = '\x03'
+	PP2_TYPE_NOOP           PP2Type = '\x04'
+	PP2_TYPE_UNIQUE_ID      PP2Type = '\x05'
+	PP2_TYPE_SSL            PP2Type = '\x20'
+	PP2_SUBTYPE_SSL_VERSION PP2Type = '\x21'
+	PP2_SUBTYPE_SSL_CN      PP2Type = '\x22'
+	PP2_SUBTYPE_SSL_CIPHER  PP2Type = '\x23'
+	PP2_SUBTYPE_SSL_SIG_ALG PP2Type = '\x24'
+	PP2_SUBTYPE_SSL_KEY_ALG PP2Type = '\x25'
+	PP2_TYPE_NETNS          PP2Type = '\x30'
+)
+
+var (
+	ErrTruncatedTLV    = errors.New("proxyproto: truncated TLV")
+	ErrTLVValueTooLong = errors.New("proxyproto: TLV value must be 65535 bytes or less")
+)
+
+// TLV is a single Type-Length-Value vector of a v2 header.
+type TLV struct {
+	Type  PP2Type
+	Value []byte
+}
+
+// SplitTLVs splits the raw TLV section of a v2 header into its vectors.
+func SplitTLVs(raw []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(raw) > 0 {
+		if len(raw) < 3 {
+			return nil, ErrTruncatedTLV
+		}
+		length := int(raw[1])<<8 | int(raw[2])
+		if len(raw) < 3+length {
+			return nil, ErrTruncatedTLV
+		}
+		tlvs = append(tlvs, TLV{
+			Type:  PP2Type(raw[0]),
+			Value: raw[3 : 3+length],
+		})
+		raw = raw[3+length:]
+	}
+	return tlvs, nil
+}
+
+// TLVs returns the Type-Length-Value vectors carried by the header.
+func (header *Header) TLVs() ([]TLV, error) {
+	return SplitTLVs(header.rawTLVs)
+}
+
+// FindTLV returns the value of the first TLV of type t. Malformed TLV sections
+// are treated as empty.
+func (header *Header) FindTLV(t PP2Type) ([]byte, bool) {
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return nil, false
+	}
+	for _, tlv := range tlvs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// FindTLVs returns the values of every TLV of type t, in header order.
+func (header *Header) FindTLVs(t PP2Type) [][]byte {
+	tlvs, _ := header.TLVs()
+	var values [][]byte
+	for _, tlv := range tlvs {
+		if tlv.Type == t {
+			values = append(values, tlv.Value)
+		}
+	}
+	return values
+}
+
+// Raw returns the bytes the header was parsed from.
+func (header *Header) Raw() []byte {
+	return header.raw
+}
+
+// JoinTLVs returns the raw TLV section of a v2 header carrying tlvs.
+func JoinTLVs(tlvs []TLV) ([]byte, error) {
+	var raw []byte
+	for _, tlv := range tlvs {
+		if len(tlv.Value) > 65535 {
+			return nil, ErrTLVValueTooLong
+		}
+		raw = append(raw, byte(tlv.Type), byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		raw = append(raw, tlv.Value...)
+	}
+	return raw, nil
+}
@@ -1,4 +1,4 @@
-package main
+package proxyproto
 
 import (
 	"bufio"
@@ -27,7 +27,7 @@ func parseVersion1(reader *bufio.Reader) (*Header, error) {
 	for {
 		b, err := reader.ReadByte()
 		if err != nil {
-			return nil, fmt.Errorf(ErrCantReadVersion1Header.Error()+": %v", err)
+			return nil, fmt.Errorf("%w: %w", ErrCantReadVersion1Header, err)
 		}
 		buf = append(buf, b)
 		if b == '\n' {
@@ -38,9 +38,6 @@ func parseVersion1(reader *bufio.Reader) (*Header, error) {
 			// No delimiter in first 107 bytes
 			return nil, ErrVersion1HeaderTooLong
 		}
-		if reader.Buffered() == 0 {
-			return nil, ErrCantReadVersion1Header
-		}
 	}
 
 	// Check for CR before LF.
@@ -73,6 +70,7 @@ func parseVersion1(reader *bufio.Reader) (*Header, error) {
 	}
 
 	header := initVersion1()
+	header.raw = buf
 
 	// Transport protocol has been processed already.
 	header.TransportProtocol = transportProtocol
@@ -101,12 +99,14 @@ func parseVersion1(reader *bufio.Reader) (*Header, error) {
 		return nil, err
 	}
 	header.SourceAddr = &net.TCPAddr{
-		IP:   sourceIP,
+		IP:   sourceIP.AsSlice(),
 		Port: sourcePort,
+		Zone: sourceIP.Zone(),
 	}
 	header.DestinationAddr = &net.TCPAddr{
-		IP:   destIP,
+		IP:   destIP.AsSlice(),
 		Port: destPort,
+		Zone: destIP.Zone(),
 	}
 
 	return header, nil
@@ -120,22 +120,70 @@ func parseV1PortNumber(portStr string) (int, error) {
 	return port, nil
 }
 
-func parseV1IPAddress(protocol AddressFamilyAndProtocol, addrStr string) (net.IP, error) {
+func parseV1IPAddress(protocol AddressFamilyAndProtocol, addrStr string) (netip.Addr, error) {
 	addr, err := netip.ParseAddr(addrStr)
 	if err != nil {
-		return nil, ErrInvalidAddress
+		return netip.Addr{}, ErrInvalidAddress
 	}
 
 	switch protocol {
 	case TCPv4:
 		if addr.Is4() {
-			return addr.AsSlice(), nil
+			return addr, nil
 		}
 	case TCPv6:
 		if addr.Is6() || addr.Is4In6() {
-			return addr.AsSlice(), nil
+			return addr, nil
 		}
 	}
 
-	return nil, ErrInvalidAddress
+	return netip.Addr{}, ErrInvalidAddress
+}
+
+func formatVersion1(header *Header) ([]byte, error) {
+	if header.Command.IsLocal() || header.TransportProtocol == UNSPEC {
+		return []byte("PROXY UNKNOWN" + crlf), nil
+	}
+
+	var proto string
+	switch header.TransportProtocol {
+	case TCPv4:
+		proto = "TCP4"
+	case TCPv6:
+		proto = "TCP6"
+	default:
+		return nil, ErrUnsupportedAddressFamilyAndProtocol
+	}
+
+	sourceAddr, sourceOK := header.SourceAddr.(*net.TCPAddr)
+	destAddr, destOK := header.DestinationAddr.(*net.TCPAddr)
+	if !sourceOK || !destOK {
+		return nil, ErrInvalidAddress
+	}
+	sourceIP, destIP := sourceAddr.IP.To16(), destAddr.IP.To16()
+	if header.TransportProtocol == TCPv4 {
+		sourceIP, destIP = sourceIP.To4(), destIP.To4()
+	}
+	if sourceIP == nil || destIP == nil {
+		return nil, ErrInvalidAddress
+	}
+	sourceText, destText := sourceIP.String(), destIP.String()
+	if header.TransportProtocol == TCPv6 {
+		// net.IP prints IPv4-mapped addresses as IPv4 ones, which TCP6 doesn't allow.
+		sourceText = netip.AddrFrom16([16]byte(sourceIP)).String()
+		destText = netip.AddrFrom16([16]byte(destIP)).String()
+	}
+	if !validPort(sourceAddr.Port) || !validPort(destAddr.Port) {
+		return nil, ErrInvalidPortNumber
+	}
+
+	line := strings.Join([]string{
+		"PROXY",
+		proto,
+		sourceText,
+		destText,
+		strconv.Itoa(sourceAddr.Port),
+		strconv.Itoa(destAddr.Port),
+	}, separator)
+	return []byte(line + crlf), nil
 }
@@ -1,4 +1,4 @@
-package main
+package proxyproto
 
 import (
 	"bufio"
@@ -51,7 +51,7 @@ func (header *Header) validateLength(length uint16) bool {
 	return false
 }
 
-func parseVersion2(reader *bufio.Reader) (header *Header, err error) {
+func parseVersion2(reader *bufio.Reader, limits *HeaderLimits) (header *Header, err error) {
 	// Skip first 12 bytes (signature)
 	for i := 0; i < 12; i++ {
 		if _, err = reader.ReadByte(); err != nil {
@@ -91,14 +91,24 @@ func parseVersion2(reader *bufio.Reader) (header *Header, err error) {
 	if !header.validateLength(length) {
 		return nil, ErrInvalidLength
 	}
+	if err := limits.checkPayload(length); err != nil {
+		return nil, err
+	}
+
+	// Keep the exact bytes of the header, the payload is copied before it is consumed.
+	header.raw = make([]byte, 0, 16+int(length))
+	header.raw = append(header.raw, SIGV2...)
+	header.raw = append(header.raw, b13, b14, byte(length>>8), byte(length))
 
 	if length == 0 {
 		return header, nil
 	}
 
-	if _, err := reader.Peek(int(length)); err != nil {
+	payload, err := reader.Peek(int(length))
+	if err != nil {
 		return nil, ErrInvalidLength
 	}
+	header.raw = append(header.raw, payload...)
 
 	// Length-limited reader for payload section
 	payloadReader := io.LimitReader(reader, int64(length)).(*io.LimitedReader)
@@ -145,6 +155,9 @@ func parseVersion2(reader *bufio.Reader) (header *Header, err error) {
 	if _, err = io.ReadFull(payloadReader, header.rawTLVs); err != nil && err != io.EOF {
 		return nil, err
 	}
+	if err := limits.checkTLVs(header.rawTLVs); err != nil {
+		return nil, err
+	}
 
 	return header, nil
 }
@@ -166,3 +179,66 @@ func newIPAddr(transport AddressFamilyAndProtocol, ip net.IP, port uint16) net.A
 		return nil
 	}
 }
+
+func formatVersion2(header *Header) ([]byte, error) {
+	var addresses []byte
+	switch {
+	case header.TransportProtocol == UNSPEC:
+	case header.TransportProtocol.IsIPv4(), header.TransportProtocol.IsIPv6():
+		sourceIP, sourcePort, sourceOK := ipAndPort(header.SourceAddr)
+		destIP, destPort, destOK := ipAndPort(header.DestinationAddr)
+		if !sourceOK || !destOK {
+			return nil, ErrInvalidAddress
+		}
+		if header.TransportProtocol.IsIPv4() {
+			sourceIP, destIP = sourceIP.To4(), destIP.To4()
+		} else {
+			sourceIP, destIP = sourceIP.To16(), destIP.To16()
+		}
+		if sourceIP == nil || destIP == nil {
+			return nil, ErrInvalidAddress
+		}
+		if !validPort(sourcePort) || !validPort(destPort) {
+			return nil, ErrInvalidPortNumber
+		}
+		addresses = append(addresses, sourceIP...)
+		addresses = append(addresses, destIP...)
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(sourcePort))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(destPort))
+	case header.TransportProtocol.IsUnix():
+		sourceAddr, sourceOK := header.SourceAddr.(*net.UnixAddr)
+		destAddr, destOK := header.DestinationAddr.(*net.UnixAddr)
+		if !sourceOK || !destOK || len(sourceAddr.Name) > 108 || len(destAddr.Name) > 108 {
+			return nil, ErrInvalidAddress
+		}
+		var addr _addrUnix
+		copy(addr.Src[:], sourceAddr.Name)
+		copy(addr.Dst[:], destAddr.Name)
+		addresses = append(addr.Src[:], addr.Dst[:]...)
+	default:
+		return nil, ErrUnsupportedAddressFamilyAndProtocol
+	}
+
+	length := len(addresses) + len(header.rawTLVs)
+	if length > 65535 {
+		return nil, ErrInvalidLength
+	}
+
+	buf := make([]byte, 0, 16+length)
+	buf = append(buf, SIGV2...)
+	buf = append(buf, byte(header.Command), byte(header.TransportProtocol))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	buf = append(buf, addresses...)
+	return append(buf, header.rawTLVs...), nil
+}
+
+func ipAndPort(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, true
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	default:
+		return nil, 0, false
+	}
+}
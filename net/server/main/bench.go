@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/gptlocal/wheels/net/proxyproto"
+)
+
+// runBench is the bench command, a load generator for PROXY-aware servers.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("target", "localhost:8080", "address of the server")
+	concurrency := fs.Int("c", 50, "connections open at once")
+	duration := fs.Duration("d", 10*time.Second, "duration of the run, 0 to run until -n connections are made")
+	connections := fs.Int("n", 0, "number of connections to make, 0 to run for -d")
+	mix := fs.String("mix", "v1=1,v2=1", "weights of header kinds: v1, v2, local, malformed")
+	payload := fs.String("payload", "GET / HTTP/1.0\r\n\r\n", "data sent after the header")
+	waitReply := fs.Bool("wait-reply", true, "wait for the first byte of the reply")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of each connection")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	headerMix, err := proxyproto.ParseHeaderMix(*mix)
+	if err != nil {
+		return err
+	}
+	g := &proxyproto.LoadGenerator{
+		Target:      *target,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		Connections: *connections,
+		Mix:         headerMix,
+		Payload:     []byte(*payload),
+		WaitReply:   *waitReply,
+		Timeout:     *timeout,
+	}
+	report, err := g.Run(context.Background())
+	if err != nil {
+		return err
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return err
+}
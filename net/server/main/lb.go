@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gptlocal/wheels/net/proxyproto"
+)
+
+// backendFlags collects repeated -backend flags.
+type backendFlags []*proxyproto.Backend
+
+func (f *backendFlags) String() string {
+	addrs := make([]string, len(*f))
+	for i, backend := range *f {
+		addrs[i] = backend.Addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (f *backendFlags) Set(s string) error {
+	backend, err := proxyproto.ParseBackend(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, backend)
+	return nil
+}
+
+// runLB is the lb command, a TCP load balancer sending PROXY headers to its backends.
+func runLB(args []string) error {
+	fs := flag.NewFlagSet("lb", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost:8080", "address to listen on")
+	acceptProxy := fs.Bool("accept-proxy", false, "read PROXY headers from incoming connections")
+	balance := fs.String("balance", "roundrobin", "backend selection, roundrobin or leastconn")
+	healthInterval := fs.Duration("health-interval", 2*time.Second, "time between health checks, 0 disables them")
+	dialTimeout := fs.Duration("dial-timeout", 5*time.Second, "timeout connecting to a backend")
+	var backends backendFlags
+	fs.Var(&backends, "backend", "backend as [v1|v2|none@]host:port, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(backends) == 0 {
+		return errors.New("lb: at least one -backend is required")
+	}
+
+	lb := &proxyproto.LoadBalancer{
+		Backends:       backends,
+		DialTimeout:    *dialTimeout,
+		HealthInterval: *healthInterval,
+	}
+	switch *balance {
+	case "roundrobin":
+		lb.Balance = proxyproto.RoundRobin
+	case "leastconn":
+		lb.Balance = proxyproto.LeastConns
+	default:
+		return fmt.Errorf("lb: unknown balance %q", *balance)
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	if *acceptProxy {
+		l = &proxyproto.Listener{Listener: l, ReadHeaderTimeout: proxyproto.DefaultReadHeaderTimeout}
+	}
+	defer l.Close()
+
+	log.Printf("lb: listening on %s, backends %s", l.Addr(), backends.String())
+	return lb.Serve(l)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gptlocal/wheels/net/proxyproto"
+)
+
+// routeFlags collects repeated -route name=addr flags.
+type routeFlags map[string]string
+
+func (f routeFlags) String() string {
+	routes := make([]string, 0, len(f))
+	for name, target := range f {
+		routes = append(routes, name+"="+target)
+	}
+	return strings.Join(routes, ",")
+}
+
+func (f routeFlags) Set(s string) error {
+	name, target, ok := strings.Cut(s, "=")
+	if !ok || name == "" || target == "" {
+		return fmt.Errorf("route %q: expected name=host:port", s)
+	}
+	f[name] = target
+	return nil
+}
+
+// runSNI is the sni command, routing TLS connections by server name without terminating them.
+func runSNI(args []string) error {
+	fs := flag.NewFlagSet("sni", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost:8443", "address to listen on")
+	acceptProxy := fs.Bool("accept-proxy", false, "read PROXY headers from incoming connections")
+	defaultTarget := fs.String("default", "", "backend of server names without a route")
+	routes := routeFlags{}
+	fs.Var(routes, "route", "route as name=host:port, repeatable, name may start with *.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(routes) == 0 && *defaultTarget == "" {
+		return errors.New("sni: at least one -route or -default is required")
+	}
+
+	router := &proxyproto.SNIRouter{
+		Routes:      routes,
+		Default:     *defaultTarget,
+		ReadTimeout: proxyproto.DefaultReadHeaderTimeout,
+		DialTimeout: 5 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	if *acceptProxy {
+		l = &proxyproto.Listener{Listener: l, ReadHeaderTimeout: proxyproto.DefaultReadHeaderTimeout}
+	}
+	defer l.Close()
+
+	log.Printf("sni: listening on %s, routes %s", l.Addr(), routes.String())
+	return router.Serve(l)
+}